@@ -0,0 +1,168 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Point the resolver at a fake cgroup filesystem and return its root.
+// v2 selects a unified hierarchy, else a v1 freezer hierarchy.
+func fakeCgroupfs(t *testing.T, v2 bool) string {
+	root := t.TempDir()
+	if v2 {
+		if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	preserve(t, &cgroupRoot)
+	preserve(t, &cgroupPathTemplate)
+	preserve(t, &verifyOpenWhiskContainers)
+	cgroupRoot, cgroupPathTemplate, verifyOpenWhiskContainers = root, "", false
+	t.Cleanup(func() {
+		cgroupPaths.Range(func(k, _ any) bool {
+			cgroupPaths.Delete(k)
+			return true
+		})
+	})
+	return root
+}
+
+// Create the cgroup of container, systemd style on v2 and cgroupfs style
+// on v1, with frozen as its initial state; returns its directory
+func fakeContainerCgroup(t *testing.T, root string, v2 bool, container string, frozen bool) string {
+	var dir string
+	var files map[string]string
+	if v2 {
+		dir = filepath.Join(root, "system.slice", "docker-"+container+".scope")
+		state := map[bool]string{false: "0", true: "1"}[frozen]
+		files = map[string]string{"cgroup.freeze": state + "\n", "cgroup.events": "populated 1\nfrozen " + state + "\n"}
+	} else {
+		dir = filepath.Join(root, "freezer", "docker", container)
+		files = map[string]string{"freezer.state": map[bool]string{false: "THAWED", true: "FROZEN"}[frozen] + "\n"}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Play the kernel for a v2 cgroup: report in cgroup.events whatever state
+// is written to cgroup.freeze
+func fakeKernel(t *testing.T, dir string) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, "cgroup.freeze")); err == nil && len(data) > 0 {
+				os.WriteFile(filepath.Join(dir, "cgroup.events"), []byte("populated 1\nfrozen "+string(data[:1])+"\n"), 0644)
+			}
+		}
+	}()
+}
+
+func TestCgroupFreezer(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("v2=%v", v2), func(t *testing.T) {
+			root := fakeCgroupfs(t, v2)
+			dir := fakeContainerCgroup(t, root, v2, "0123456789ab", false)
+			if v2 {
+				fakeKernel(t, dir)
+			}
+			ops := CgroupFreezerOps{}
+			for _, freeze := range []bool{true, false} {
+				var err error
+				if freeze {
+					err = ops.Suspend(context.Background(), "0123456789ab")
+				} else {
+					err = ops.Resume(context.Background(), "0123456789ab")
+				}
+				if err != nil {
+					t.Fatalf("freeze=%v: %v", freeze, err)
+				}
+				if frozen, err := isCgroupFrozen("0123456789ab"); err != nil || frozen != freeze {
+					t.Errorf("after freeze=%v, frozen is %v, %v", freeze, frozen, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCgroupFreezerNoCgroup(t *testing.T) {
+	fakeCgroupfs(t, true)
+	err := CgroupFreezerOps{}.Suspend(context.Background(), "0123456789ab")
+	if errorStatus(err) != 404 {
+		t.Errorf("got %v; want a 404", err)
+	}
+}
+
+func TestCgroupFreezerTimeout(t *testing.T) {
+	root := fakeCgroupfs(t, true)
+	// No fakeKernel: cgroup.events never reports the cgroup frozen
+	fakeContainerCgroup(t, root, true, "0123456789ab", false)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := CgroupFreezerOps{}.Suspend(ctx, "0123456789ab")
+	if errorStatus(err) != 504 {
+		t.Errorf("got %v; want a 504", err)
+	}
+}
+
+func TestListPausedCgroup(t *testing.T) {
+	root := fakeCgroupfs(t, false)
+	fakeContainerCgroup(t, root, false, "f302e0000000", true)
+	fakeContainerCgroup(t, root, false, "7a3ed0000000", false)
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		// docker does not know about cgroup freezes, so all appear running
+		fmt.Fprint(w, `[{"Id":"f302e0000000"},{"Id":"7a3ed0000000"},{"Id":"90ae00000000"}]`)
+	})
+	preserve(t, &containerRuntime)
+	containerRuntime = "cgroup"
+
+	resp := serve(httptest.NewRequest("GET", "/paused", nil))
+	var ids []string
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil || resp.Code != 200 {
+		t.Fatalf("got %d, %v", resp.Code, err)
+	}
+	if len(ids) != 1 || ids[0] != "f302e0000000" {
+		t.Errorf("got %v; want [f302e0000000]", ids)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/* Mount point of the cgroup filesystem, scanned when cgroupPathTemplate is empty */
+var cgroupRoot = "/sys/fs/cgroup"
+
+/* Cgroup directories found by scanning, by container */
+var cgroupPaths sync.Map
+
+var errNoCgroup = errors.New("no cgroup found")
+
+// The hierarchy holding container cgroups: the unified hierarchy on
+// cgroup v2, else the v1 freezer hierarchy
+func cgroupHierarchy() string {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		return cgroupRoot
+	}
+	return filepath.Join(cgroupRoot, "freezer")
+}
+
+// Check at startup that container cgroups can be resolved: a template
+// must name the container and lie in an existing directory, and
+// autodetection needs a cgroup hierarchy to scan
+func validateCgroupResolver() error {
+	if cgroupPathTemplate != "" {
+		i := strings.Index(cgroupPathTemplate, "{container}")
+		if i < 0 {
+			return fmt.Errorf("Invalid INVOKER_AGENT_CGROUP_PATH_TEMPLATE %s; must contain {container}", cgroupPathTemplate)
+		}
+		parent := filepath.Dir(cgroupPathTemplate[:i] + "x")
+		if _, err := os.Stat(parent); err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_CGROUP_PATH_TEMPLATE %s; error was %v", cgroupPathTemplate, err)
+		}
+		return nil
+	}
+	if _, err := os.Stat(cgroupHierarchy()); err != nil {
+		return fmt.Errorf("Unable to autodetect container cgroups; set INVOKER_AGENT_CGROUP_PATH_TEMPLATE: %v", err)
+	}
+	return nil
+}
+
+/* What a runtime container id looks like; anything else could name a host cgroup (eg system.slice) */
+var containerIdPattern = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
+/* Prefixes of the systemd scopes runtimes create for containers, eg docker-<id>.scope */
+var containerScopePrefixes = []string{"docker-", "cri-containerd-", "crio-", "libpod-"}
+
+// Is path the cgroup directory of container? Only container leaves match:
+// a runtime's systemd scope (eg docker-<id>.scope) or, with the cgroupfs
+// driver, <id> directly under a docker directory
+func isContainerCgroup(path string, container string) bool {
+	name := filepath.Base(path)
+	for _, prefix := range containerScopePrefixes {
+		if name == prefix+container+".scope" {
+			return true
+		}
+	}
+	return name == container && filepath.Base(filepath.Dir(path)) == "docker"
+}
+
+// Directory of container's cgroup: cgroupPathTemplate expanded, or else
+// found by scanning the cgroup hierarchy. Returns errNoCgroup if container
+// is not a container id or a scan turns up nothing. Scan results are cached
+// until the directory goes away.
+func resolveCgroupPath(container string) (string, error) {
+	// Act only on container ids, so neither a template nor a scan can
+	// lead to another directory, or to the host's own cgroups
+	if !containerIdPattern.MatchString(container) {
+		return "", errNoCgroup
+	}
+	if cgroupPathTemplate != "" {
+		return strings.ReplaceAll(cgroupPathTemplate, "{container}", container), nil
+	}
+	if cached, ok := cgroupPaths.Load(container); ok {
+		if _, err := os.Stat(cached.(string)); err == nil {
+			return cached.(string), nil
+		}
+		cgroupPaths.Delete(container)
+	}
+
+	found := ""
+	err := filepath.WalkDir(cgroupHierarchy(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// cgroups come and go while we scan; skip those that vanished
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && isContainerCgroup(path, container) {
+			found = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", errNoCgroup
+	}
+	cgroupPaths.Store(container, found)
+	return found, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveCgroupPathLayouts(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("v2=%v", v2), func(t *testing.T) {
+			root := fakeCgroupfs(t, v2)
+			hierarchy := root
+			if !v2 {
+				hierarchy = filepath.Join(root, "freezer")
+			}
+			for _, test := range []struct{ container, dir string }{
+				{"0123456789ab", "system.slice/docker-0123456789ab.scope"},                                    // systemd driver
+				{"123456789abc", "docker/123456789abc"},                                                       // cgroupfs driver
+				{"23456789abcd", "kubepods.slice/kubepods-burstable.slice/cri-containerd-23456789abcd.scope"}, // kubelet with systemd
+				{"3456789abcde", "machine.slice/libpod-3456789abcde.scope"},                                   // podman
+			} {
+				want := filepath.Join(hierarchy, test.dir)
+				if err := os.MkdirAll(want, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if got, err := resolveCgroupPath(test.container); err != nil || got != want {
+					t.Errorf("%s resolved to %s, %v; want %s", test.container, got, err, want)
+				}
+			}
+			if _, err := resolveCgroupPath("ffffffffffff"); err != errNoCgroup {
+				t.Errorf("got %v for an unknown container; want errNoCgroup", err)
+			}
+		})
+	}
+}
+
+func TestResolveCgroupPathCache(t *testing.T) {
+	root := fakeCgroupfs(t, true)
+	first := filepath.Join(root, "system.slice", "docker-0123456789ab.scope")
+	if err := os.MkdirAll(first, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := resolveCgroupPath("0123456789ab"); got != first {
+		t.Fatalf("resolved to %s; want %s", got, first)
+	}
+	// A restarted container may get a new cgroup; the stale entry is dropped
+	os.Remove(first)
+	second := filepath.Join(root, "docker", "0123456789ab")
+	if err := os.MkdirAll(second, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := resolveCgroupPath("0123456789ab"); got != second {
+		t.Errorf("resolved to %s after the move; want %s", got, second)
+	}
+}
+
+func TestResolveCgroupPathTemplate(t *testing.T) {
+	fakeCgroupfs(t, true)
+	cgroupPathTemplate = "/sys/fs/cgroup/system.slice/docker-{container}.scope"
+	if got, err := resolveCgroupPath("0123456789ab"); err != nil || got != "/sys/fs/cgroup/system.slice/docker-0123456789ab.scope" {
+		t.Errorf("got %s, %v", got, err)
+	}
+	// Names must not escape the template
+	for _, container := range []string{"", ".", "..", "../../etc", "a/b"} {
+		if got, err := resolveCgroupPath(container); err != errNoCgroup {
+			t.Errorf("%q resolved to %s, %v; want errNoCgroup", container, got, err)
+		}
+	}
+}
+
+func TestValidateCgroupResolver(t *testing.T) {
+	root := fakeCgroupfs(t, true)
+	if err := validateCgroupResolver(); err != nil {
+		t.Errorf("autodetection on a cgroup v2 root: %v", err)
+	}
+	for template, ok := range map[string]bool{
+		filepath.Join(root, "{container}"):                  true,
+		filepath.Join(root, "docker-{container}.scope"):     true,
+		filepath.Join(root, "system.slice"):                 false, // no {container}
+		filepath.Join(root, "missing", "{container}.scope"): false,
+	} {
+		cgroupPathTemplate = template
+		if err := validateCgroupResolver(); (err == nil) != ok {
+			t.Errorf("%s: got %v; want ok %v", template, err, ok)
+		}
+	}
+	cgroupPathTemplate, cgroupRoot = "", filepath.Join(root, "missing")
+	if err := validateCgroupResolver(); err == nil {
+		t.Error("want an error with no cgroup hierarchy to scan")
+	}
+}
+
+func TestResolveCgroupPathRejectsHostCgroups(t *testing.T) {
+	root := fakeCgroupfs(t, true)
+	for _, dir := range []string{
+		"init.scope",
+		"system.slice/docker.service",
+		"user.slice/user-0.slice/session-1.scope",
+		"kubepods.slice/0123456789ab", // an id, but not a container leaf
+	} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Freezing any of these would freeze the node rather than a container
+	for _, container := range []string{"system.slice", "user.slice", "init.scope", "docker.service", "1", "0", "0123456789ab"} {
+		if got, err := resolveCgroupPath(container); err != errNoCgroup {
+			t.Errorf("%s resolved to %s, %v; want errNoCgroup", container, got, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Backend wrapper failing fast while the runtime is down.
+// After breakerThreshold consecutive runtime failures the breaker opens:
+// operations are refused with 503 for breakerCooldown, after which a single
+// operation is let through to probe whether the runtime has recovered.
+type CircuitBreakerOps struct {
+	SuspendResumeOps
+	mu        sync.Mutex
+	failures  int       // consecutive runtime failures
+	openUntil time.Time // while failures >= breakerThreshold, refuse operations until then
+	probing   bool      // is the half-open probe in flight?
+}
+
+func NewCircuitBreakerOps(ops SuspendResumeOps) *CircuitBreakerOps {
+	return &CircuitBreakerOps{SuspendResumeOps: ops}
+}
+
+func (b *CircuitBreakerOps) Suspend(ctx context.Context, container string) error {
+	return b.call(ctx, container, "Pausing", b.SuspendResumeOps.Suspend)
+}
+
+func (b *CircuitBreakerOps) Resume(ctx context.Context, container string) error {
+	return b.call(ctx, container, "Unpausing", b.SuspendResumeOps.Resume)
+}
+
+// Did err show the runtime to be failing, rather than refusing one operation?
+// Statuses below 500 are answers from a working runtime, and 503 means the
+// agent itself is saturated.
+func isRuntimeFailure(err error) bool {
+	var oe *opError
+	if errors.As(err, &oe) {
+		return oe.status >= 500 && oe.status != 503
+	}
+	return err != nil
+}
+
+// Run op on container unless the breaker is open.
+// verb describes the operation in error messages (eg "Pausing").
+func (b *CircuitBreakerOps) call(ctx context.Context, container string, verb string, op func(context.Context, string) error) error {
+	b.mu.Lock()
+	isProbe := false
+	if b.failures >= breakerThreshold {
+		if wait := time.Until(b.openUntil); wait > 0 || b.probing {
+			b.mu.Unlock()
+			circuitBreakerRejected.Add(1)
+			if wait <= 0 {
+				wait = time.Second
+			}
+			return &opError{503, fmt.Sprintf("%s %s refused: the %s backend is failing", verb, container, b.Name()), wait}
+		}
+		b.probing, isProbe = true, true
+	}
+	b.mu.Unlock()
+
+	err := op(ctx, container)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Calls admitted before the breaker opened must not end another's probe
+	if isProbe {
+		b.probing = false
+	}
+	if ctx.Err() == context.Canceled {
+		// The caller went away; this says nothing about the runtime
+		return err
+	}
+	if isRuntimeFailure(err) {
+		b.failures++
+		if b.failures >= breakerThreshold {
+			b.openUntil = time.Now().Add(breakerCooldown)
+			if b.failures == breakerThreshold {
+				fmt.Fprintf(os.Stdout, "Circuit breaker opened after %d consecutive failures of the %s backend\n", b.failures, b.Name())
+			}
+		}
+	} else {
+		if b.failures >= breakerThreshold {
+			fmt.Fprintf(os.Stdout, "Circuit breaker closed; the %s backend has recovered\n", b.Name())
+		}
+		b.failures = 0
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Backend answering each operation with whatever op returns
+type stubOps struct {
+	op func(container string) error
+}
+
+func (stubOps) Name() string {
+	return "stub"
+}
+
+func (s stubOps) Suspend(ctx context.Context, container string) error {
+	return s.op(container)
+}
+
+func (s stubOps) Resume(ctx context.Context, container string) error {
+	return s.op(container)
+}
+
+var errRuntimeDown = &opError{status: 500, msg: "runtime down"}
+
+func useBreaker(t *testing.T, threshold int, cooldown time.Duration) {
+	preserve(t, &breakerThreshold)
+	preserve(t, &breakerCooldown)
+	breakerThreshold, breakerCooldown = threshold, cooldown
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	useBreaker(t, 2, time.Hour)
+	calls := 0
+	b := NewCircuitBreakerOps(stubOps{func(string) error {
+		calls++
+		return errRuntimeDown
+	}})
+	for i := 0; i < 2; i++ {
+		if err := b.Suspend(context.Background(), "wsk0"); err != errRuntimeDown {
+			t.Fatalf("call %d: got %v; want the backend's error", i, err)
+		}
+	}
+	err := b.Suspend(context.Background(), "wsk0")
+	if oe, ok := err.(*opError); !ok || oe.status != 503 || oe.retryAfter <= 0 {
+		t.Errorf("got %v; want a 503 with Retry-After", err)
+	}
+	if calls != 2 {
+		t.Errorf("backend called %d times; want 2", calls)
+	}
+}
+
+func TestCircuitBreakerIgnoresRefusals(t *testing.T) {
+	useBreaker(t, 1, time.Hour)
+	b := NewCircuitBreakerOps(stubOps{func(string) error {
+		return &opError{status: 404, msg: "no such container"}
+	}})
+	for i := 0; i < 3; i++ {
+		if err := b.Suspend(context.Background(), "wsk0"); errorStatus(err) != 404 {
+			t.Fatalf("call %d: got %v; want a 404", i, err)
+		}
+	}
+}
+
+func TestCircuitBreakerRecovers(t *testing.T) {
+	useBreaker(t, 1, 10*time.Millisecond)
+	var result error = errRuntimeDown
+	b := NewCircuitBreakerOps(stubOps{func(string) error { return result }})
+	b.Suspend(context.Background(), "wsk0")
+	if err := b.Suspend(context.Background(), "wsk0"); errorStatus(err) != 503 {
+		t.Fatalf("got %v; want a 503 while open", err)
+	}
+
+	// A failed probe reopens the breaker
+	time.Sleep(20 * time.Millisecond)
+	if err := b.Suspend(context.Background(), "wsk0"); err != errRuntimeDown {
+		t.Fatalf("got %v; want the probe to reach the backend", err)
+	}
+	if err := b.Suspend(context.Background(), "wsk0"); errorStatus(err) != 503 {
+		t.Fatalf("got %v; want a 503 after the failed probe", err)
+	}
+
+	// A successful probe closes it
+	time.Sleep(20 * time.Millisecond)
+	result = nil
+	for i := 0; i < 2; i++ {
+		if err := b.Suspend(context.Background(), "wsk0"); err != nil {
+			t.Fatalf("call %d: got %v; want success", i, err)
+		}
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	useBreaker(t, 1, 10*time.Millisecond)
+	// Operations on "before" and "probe" block until released; others fail immediately
+	release := map[string]chan struct{}{"before": make(chan struct{}), "probe": make(chan struct{})}
+	entered := make(chan string, 2)
+	b := NewCircuitBreakerOps(stubOps{func(container string) error {
+		if ch, ok := release[container]; ok {
+			entered <- container
+			<-ch
+		}
+		return errRuntimeDown
+	}})
+
+	// An operation admitted while the breaker is closed, still running
+	// when a later failure opens it. Its caller gives up, so its outcome
+	// leaves the failure count alone.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 2)
+	go func() { done <- b.Suspend(ctx, "before") }()
+	<-entered
+	b.Suspend(context.Background(), "wsk0")
+
+	time.Sleep(20 * time.Millisecond)
+	go func() { done <- b.Suspend(context.Background(), "probe") }()
+	<-entered
+
+	// The earlier operation finishing must not end the probe
+	cancel()
+	close(release["before"])
+	<-done
+	if err := b.Suspend(context.Background(), "wsk0"); errorStatus(err) != 503 {
+		t.Errorf("got %v; want a 503 while the probe is in flight", err)
+	}
+	close(release["probe"])
+	<-done
+}
+
+func TestCircuitBreakerIgnoresDockerConflicts(t *testing.T) {
+	useBreaker(t, 3, time.Hour)
+	// Like docker with wsk0 already paused: pausing it again is refused
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /containers/wsk0/json":
+			fmt.Fprint(w, `{"Name":"/wsk0","State":{"Status":"paused"}}`)
+		case "POST /containers/wsk0/pause":
+			w.WriteHeader(409)
+			fmt.Fprint(w, `{"message":"Container wsk0 is already paused"}`)
+		default:
+			w.WriteHeader(204)
+		}
+	})
+	b := NewCircuitBreakerOps(DockerSuspendResumeOps{})
+	for i := 0; i < 5; i++ {
+		if err := b.Suspend(context.Background(), "wsk0"); errorStatus(err) != 409 {
+			t.Fatalf("pause %d: got %v; want docker's 409", i, err)
+		}
+	}
+	if err := b.Resume(context.Background(), "wsk9"); err != nil {
+		t.Errorf("got %v; want the breaker closed after conflicts", err)
+	}
+}
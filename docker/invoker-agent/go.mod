@@ -0,0 +1,8 @@
+module invoker-agent
+
+go 1.21
+
+require (
+	github.com/gorilla/mux v1.8.1
+	gopkg.in/yaml.v3 v3.0.1
+)
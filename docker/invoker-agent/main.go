@@ -18,38 +18,590 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-/* Should we measure and report time taken for each operation? */
-const timeOps = false
+/* Exit codes for fatal startup errors, so orchestration can tell them apart */
+const (
+	exitConfigError = 2 // invalid configuration
+	exitBindError   = 3 // unable to listen on the configured port
+)
 
-/* configuration variables; may be overridden by setting matching envvar */
+/* configuration variables; may be overridden by setting matching envvar (or config file key) */
 var (
-	dockerSock       string = "/var/run/docker.sock"
-	containerDir     string = "/containers"
-	invokerAgentPort int    = 3233
+	timeOps           bool          = false // measure and report time taken for each operation?
+	timeOpsStdout     bool          = true  // with timeOps, also report timings on stdout?
+	containerRuntime  string        = ""    // backend for suspend/resume: docker, podman or cgroup; empty autodetects
+	dockerSock        string        = ""    // docker API socket; empty means the runtime's default
+	dockerTcpAddress  string        = ""    // if set, reach docker at this host:port instead of dockerSock
+	dockerTlsCa       string        = ""    // CA bundle verifying a TCP docker endpoint; enables TLS
+	dockerTlsCert     string        = ""    // client certificate for a TCP docker endpoint; enables TLS
+	dockerTlsKey      string        = ""    // key for dockerTlsCert
+	containerDir      string        = "/containers"
+	invokerAgentPort  int           = 3233
+	bindAddress       string        = ""    // address to listen on; empty means all interfaces
+	pprofEnabled      bool          = false // serve net/http/pprof on pprofPort
+	pprofPort         int           = 6060
+	pprofBindAddress  string        = "127.0.0.1"   // address pprof listens on; loopback keeps profiles off the node's network
+	gcPercent         int           = 100           // GOGC; a negative value disables the collector; unset keeps the runtime's
+	memoryLimit       int64         = math.MaxInt64 // soft memory limit in bytes; unset keeps the runtime's
+	requestTimeout    time.Duration = 0             // overall deadline per request; 0 means none
+	asyncOps          bool          = false         // run suspend/resume in the background, returning 202
+	operationTTL      time.Duration = 5 * time.Minute
+	maxDockerConns    int           = 0                // bound on concurrent docker requests; 0 means unbounded
+	dockerRetryAfter  time.Duration = time.Second      // Retry-After reported when docker rate limits us
+	dockerDialTimeout time.Duration = 5 * time.Second  // timeout for connecting to dockerSock
+	dockerTimeout     time.Duration = 30 * time.Second // overall timeout for each docker request
+	errorFormat       string        = "plain"          // format of error responses: plain, json or problem
+	containerOpRate   float64       = 0                // suspend/resume per second allowed per container; 0 means unlimited
+	containerOpBurst  int           = 10               // burst of suspend/resume allowed per container
+	auditFile         string        = ""               // append-only audit trail of container operations; empty disables
+	logLevel          string        = "info"           // info or debug; SIGUSR1 toggles debug at runtime
+
+	serverReadTimeout  time.Duration = 10 * time.Second  // time allowed to read a request, including its headers
+	serverWriteTimeout time.Duration = 60 * time.Second  // time allowed to handle a request and write the response
+	serverIdleTimeout  time.Duration = 120 * time.Second // time an idle keep-alive connection is kept open
+
+	containerAllowPattern     *regexp.Regexp = nil   // if set, only containers whose whole name matches this are acted on
+	exitedContainerStatus     int            = 410   // status reported for operations on exited containers
+	verifyOpenWhiskContainers bool           = false // inspect containers and refuse those not created by OpenWhisk
+	openwhiskNamePrefix       string         = "wsk" // container (or pod) name prefix identifying OpenWhisk containers
+	openwhiskLabel            string         = ""    // if set, a label identifying OpenWhisk containers
+
+	adminToken     string       = ""  // bearer token required by the /admin routes; empty disables them
+	trustedProxies []*net.IPNet = nil // peers whose X-Forwarded-For is believed when identifying clients
+
+	cgroupPathTemplate string = "" // container cgroup directory for the cgroup runtime, with {container} replaced; empty autodetects
+
+	latencyHistogram bool = false // keep recent backend latencies, reporting p50/p99 per op in /metrics
+
+	dockerSockFallback string = "" // docker API socket dialed when dockerSock cannot be
+
+	breakerThreshold int           = 0                // consecutive backend failures opening the circuit breaker; 0 disables it
+	breakerCooldown  time.Duration = 10 * time.Second // time an open circuit breaker refuses operations before probing
 )
 
-/* http.Client instance bound to dockerSock */
+/* http.Client instance bound to dockerSock (or dockerTcpAddress) */
 var client *http.Client
 
+/* Semaphore bounding concurrent docker requests to maxDockerConns; nil if unbounded */
+var dockerSem chan struct{}
+
+/* Metrics, served as JSON by the /metrics route */
+var (
+	dockerRequestsInFlight    = expvar.NewInt("dockerRequestsInFlight")
+	dockerRequestsRejected    = expvar.NewInt("dockerRequestsRejected")
+	dockerRequestsRateLimited = expvar.NewInt("dockerRequestsRateLimited")
+	containerOpsThrottled     = expvar.NewInt("containerOpsThrottled")
+	dockerFallbackDials       = expvar.NewInt("dockerFallbackDials")
+	circuitBreakerRejected    = expvar.NewInt("circuitBreakerRejected")
+)
 
 /*
- * Suppout for suspend/resume operations
+ * Support for correlating requests with OpenWhisk activations
  */
 
-// handler for /resume/<container> route
+type contextKey int
+
+const (
+	activationIdKey contextKey = iota
+	serverTimingKey
+)
+
+// Middleware that extracts the activation id from the X-Activation-Id
+// (or X-Request-Id) header, generating a fresh one if neither was given.
+// The id is stored in the request context and echoed in the response.
+func withActivationId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Activation-Id")
+		if id == "" {
+			id = r.Header.Get("X-Request-Id")
+		}
+		if id == "" {
+			id = generateId()
+		}
+		w.Header().Set("X-Activation-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), activationIdKey, id)))
+	})
+}
+
+// A random hex identifier, used for activation and operation ids
+func generateId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// The activation id associated with r by withActivationId
+func activationId(r *http.Request) string {
+	if id, ok := r.Context().Value(activationIdKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// Log a line to stdout tagged with the activation id of r
+func logRequest(r *http.Request, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stdout, "[activationId=%s] %s\n", activationId(r), fmt.Sprintf(format, args...))
+}
+
+// Like logRequest, but only while debug logging is on
+func logRequestDebug(r *http.Request, format string, args ...interface{}) {
+	if debugLogging.Load() {
+		logRequest(r, format, args...)
+	}
+}
+
+/* Is debug logging currently on? Starts from logLevel; toggled by SIGUSR1 */
+var debugLogging atomic.Bool
+
+// Toggle debug logging on each signal received (SIGUSR1, as registered by
+// main), so operators can capture diagnostics without restarting the agent
+func handleLogLevelSignals(signals <-chan os.Signal) {
+	for range signals {
+		on := !debugLogging.Load()
+		debugLogging.Store(on)
+		if on {
+			fmt.Fprintln(os.Stdout, "Received SIGUSR1; debug logging enabled")
+		} else {
+			fmt.Fprintf(os.Stdout, "Received SIGUSR1; debug logging disabled (log level %s)\n", logLevel)
+		}
+	}
+}
+
+/*
+ * Support for reporting per-request timings in a Server-Timing header
+ */
+
+/* Phases of one request timed so far, as Server-Timing metrics */
+type serverTiming struct {
+	sync.Mutex
+	metrics []string
+}
+
+// ResponseWriter that adds the Server-Timing header just before the response headers are sent
+type serverTimingWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	timing      *serverTiming
+	wroteHeader bool
+}
+
+func (tw *serverTimingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.timing.Lock()
+		metrics := append(tw.timing.metrics, timingMetric("total", time.Since(tw.start)))
+		tw.timing.Unlock()
+		tw.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *serverTimingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(200)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func timingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d)/float64(time.Millisecond))
+}
+
+// Middleware that reports a Server-Timing header when timeOps is enabled
+func withServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !timeOps {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timing := &serverTiming{}
+		tw := &serverTimingWriter{ResponseWriter: w, start: time.Now(), timing: timing}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), serverTimingKey, timing)))
+	})
+}
+
+// Record that phase name of r took d, for its Server-Timing header
+func recordTiming(r *http.Request, name string, d time.Duration) {
+	if timing, ok := r.Context().Value(serverTimingKey).(*serverTiming); ok {
+		timing.Lock()
+		timing.metrics = append(timing.metrics, timingMetric(name, d))
+		timing.Unlock()
+	}
+}
+
+// Middleware that bounds every request by requestTimeout (if configured)
+func withRequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+/*
+ * Support for suspend/resume operations
+ */
+
+// An error from a container operation, carrying the HTTP status to report
+type opError struct {
+	status     int
+	msg        string
+	retryAfter time.Duration // if non-zero, sent to the caller as Retry-After
+}
+
+func (e *opError) Error() string {
+	return e.msg
+}
+
+// The status to report for err, which resulted from a container operation.
+// Sets Retry-After on w if err calls for it.
+func opErrorStatus(w http.ResponseWriter, err error) int {
+	if oe, ok := err.(*opError); ok && oe.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(oe.retryAfter.Seconds()))))
+	}
+	return errorStatus(err)
+}
+
+// The status reported for err, which resulted from a container operation
+func errorStatus(err error) int {
+	if oe, ok := err.(*opError); ok {
+		return oe.status
+	}
+	return 500
+}
+
+// Report err, which resulted from a container operation, to the caller
+func writeOpError(w http.ResponseWriter, err error) {
+	writeError(w, opErrorStatus(w, err), err.Error())
+}
+
+/* Body of an error response in the problem format (RFC 7807) */
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Send an error response in the configured errorFormat
+func writeError(w http.ResponseWriter, status int, msg string) {
+	switch errorFormat {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	case "problem":
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(problemDetails{"about:blank", http.StatusText(status), status, msg})
+	default:
+		w.WriteHeader(status)
+		fmt.Fprintln(w, msg)
+	}
+}
+
+// Does body, from a docker 500 response, indicate the daemon is rate limiting us?
+func isRateLimitMessage(body []byte) bool {
+	msg := strings.ToLower(string(body))
+	return strings.Contains(msg, "too many requests") || strings.Contains(msg, "rate limit")
+}
+
+var errDockerBusy = errors.New("too many concurrent docker requests")
+
+// Response body that ends its docker request when closed
+type dockerResponseBody struct {
+	io.ReadCloser
+	done sync.Once
+	end  func()
+}
+
+func (b *dockerResponseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done.Do(b.end)
+	return err
+}
+
+// Issue req to the docker daemon, failing fast with errDockerBusy if
+// maxDockerConns requests are already outstanding. A request is
+// outstanding until its response body is closed, as until then it holds
+// its connection to the daemon.
+func dockerDo(req *http.Request) (*http.Response, error) {
+	sem := dockerSem
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		default:
+			dockerRequestsRejected.Add(1)
+			return nil, errDockerBusy
+		}
+	}
+	dockerRequestsInFlight.Add(1)
+	end := func() {
+		dockerRequestsInFlight.Add(-1)
+		if sem != nil {
+			<-sem
+		}
+	}
+	if debugLogging.Load() {
+		// req carries the context of the agent request it serves, so logs correlate
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+			logRequestDebug(req, "Docker %s %s served by %s", req.Method, req.URL.Path, info.Conn.RemoteAddr())
+		}}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		end()
+		return nil, err
+	}
+	resp.Body = &dockerResponseBody{ReadCloser: resp.Body, end: end}
+	return resp, nil
+}
+
+// Issue method on path to the docker API.
+// The request is bound to ctx, so it is abandoned if ctx is cancelled.
+func dockerRequest(ctx context.Context, method string, path string) (*http.Response, error) {
+	scheme := "http"
+	if useDockerTls() {
+		scheme = "https"
+	}
+	// The client dials the docker endpoint itself, so the host here is nominal
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://localhost"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if method == "POST" {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	return dockerDo(req)
+}
+
+// Read any unconsumed remainder of a docker response body before closing
+// it, so its connection to the daemon can be reused for the next request
+func drainAndClose(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// Status code to report when a docker request made under ctx failed with err
+func transportErrorStatus(ctx context.Context, err error) int {
+	var netErr net.Error
+	if ctx.Err() == context.DeadlineExceeded || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return 504
+	} else if err == errDockerBusy {
+		return 503
+	}
+	return 500
+}
+
+/* The subset of docker's container inspect response used by the agent */
+type containerInfo struct {
+	Name   string
+	Config struct {
+		Labels map[string]string
+	}
+	State struct {
+		Status string // eg "running", "paused", "exited"
+	}
+}
+
+// Has the inspected container terminated, so it can never be resumed?
+func hasExited(info *containerInfo) bool {
+	switch info.State.Status {
+	case "exited", "dead", "removing":
+		return true
+	}
+	return false
+}
+
+// Was the inspected container created by OpenWhisk?
+func isOpenWhiskContainer(info *containerInfo) bool {
+	if openwhiskLabel != "" {
+		if _, ok := info.Config.Labels[openwhiskLabel]; ok {
+			return true
+		}
+	}
+	if openwhiskNamePrefix != "" {
+		if strings.HasPrefix(strings.TrimPrefix(info.Name, "/"), openwhiskNamePrefix) {
+			return true
+		}
+		// Containers started by the kubelet are named after their pod
+		if strings.HasPrefix(info.Config.Labels["io.kubernetes.pod.name"], openwhiskNamePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ask docker to inspect container.
+// verb describes the operation on whose behalf we inspect, for error messages.
+func inspectContainer(ctx context.Context, container string, verb string) (*containerInfo, error) {
+	resp, err := dockerRequest(ctx, "GET", "/containers/"+container+"/json")
+	if err != nil {
+		return nil, &opError{status: transportErrorStatus(ctx, err), msg: fmt.Sprintf("%s %s failed: unable to inspect container: %v", verb, container, err)}
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode == 404 {
+		return nil, &opError{status: 404, msg: fmt.Sprintf("%s %s failed: no such container", verb, container)}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &opError{status: 500, msg: fmt.Sprintf("%s %s failed: inspect returned status code: %d", verb, container, resp.StatusCode)}
+	}
+	var info containerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, &opError{status: 500, msg: fmt.Sprintf("%s %s failed: unable to parse inspect response: %v", verb, container, err)}
+	}
+	return &info, nil
+}
+
+// Inspect container and reject it unless it belongs to OpenWhisk
+func verifyOpenWhiskContainer(ctx context.Context, container string, verb string) error {
+	info, err := inspectContainer(ctx, container, verb)
+	if err != nil {
+		return err
+	}
+	if !isOpenWhiskContainer(info) {
+		return &opError{status: 403, msg: fmt.Sprintf("%s %s refused: not an OpenWhisk container", verb, container)}
+	}
+	return nil
+}
+
+// Perform the docker operation op (pause/unpause) on container.
+// verb describes the operation in error messages (eg "Pausing").
+func doContainerOp(ctx context.Context, container string, op string, verb string) error {
+	if verifyOpenWhiskContainers {
+		if err := verifyOpenWhiskContainer(ctx, container, verb); err != nil {
+			return err
+		}
+	}
+	resp, err := dockerRequest(ctx, "POST", "/containers/"+container+"/"+op)
+	if err != nil {
+		return &opError{status: transportErrorStatus(ctx, err), msg: fmt.Sprintf("%s %s failed with error: %v", verb, container, err)}
+	}
+	var body []byte
+	if resp.StatusCode == 500 {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, 4096))
+	}
+	// Release the connection now: with maxDockerConns, the inspect below
+	// could otherwise wait for the very connection this response holds
+	drainAndClose(resp)
+	if resp.StatusCode == 500 && isRateLimitMessage(body) {
+		dockerRequestsRateLimited.Add(1)
+		return &opError{429, fmt.Sprintf("%s %s was rate limited by docker: %s", verb, container, strings.TrimSpace(string(body))), dockerRetryAfter}
+	}
+	if resp.StatusCode == 404 {
+		return &opError{status: 404, msg: fmt.Sprintf("%s %s failed: no such container", verb, container)}
+	}
+	if resp.StatusCode == 409 {
+		// Docker refuses to (un)pause a container that is not running, or
+		// that is already in the requested state; distinguish one that has
+		// exited from a conflict, which is passed on as docker's answer
+		info, err := inspectContainer(ctx, container, verb)
+		if err != nil {
+			return err
+		}
+		if hasExited(info) {
+			return &opError{status: exitedContainerStatus, msg: fmt.Sprintf("%s %s failed: container has %s", verb, container, info.State.Status)}
+		}
+		return &opError{status: 409, msg: fmt.Sprintf("%s %s refused by docker: container is %s", verb, container, info.State.Status)}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &opError{status: 500, msg: fmt.Sprintf("%s %s failed with status code: %d", verb, container, resp.StatusCode)}
+	}
+	return nil
+}
+
+// Perform op (pause/unpause) on container using suspendResumeOps
+func performContainerOp(ctx context.Context, container string, op string) error {
+	if latencyHistogram {
+		defer recordOpLatency(op, time.Now())
+	}
+	if op == "pause" {
+		return suspendResumeOps.Suspend(ctx, container)
+	}
+	return suspendResumeOps.Resume(ctx, container)
+}
+
+// Run op (pause/unpause) on container on behalf of r, applying rate
+// limiting and, if enabled, async mode. Returns the id of the started
+// operation in async mode, or else the result of the operation.
+// status is what the caller responds with on success, for the audit trail.
+func executeContainerOp(r *http.Request, container string, op string, verb string, status int) (string, error) {
+	logRequestDebug(r, "%s %s using the %s backend", verb, container, suspendResumeOps.Name())
+	if containerOpsDisabled.Load() {
+		err := &opError{status: 503, msg: fmt.Sprintf("%s %s refused: suspend/resume is disabled by an operator", verb, container)}
+		logRequest(r, "%v", err)
+		return "", err
+	}
+	if containerAllowPattern != nil && !containerAllowPattern.MatchString(container) {
+		err := &opError{status: 403, msg: fmt.Sprintf("%s %s refused: container does not match the allowed pattern", verb, container)}
+		logRequest(r, "%v", err)
+		return "", err
+	}
+	if wait := takeContainerToken(container, time.Now()); wait > 0 {
+		containerOpsThrottled.Add(1)
+		err := &opError{429, fmt.Sprintf("%s %s refused: too many operations on this container", verb, container), wait}
+		logRequest(r, "%v", err)
+		return "", err
+	}
+	if asyncOps {
+		return startAsyncOperation(r, container, op), nil
+	}
+	backendStart := time.Now()
+	err := performContainerOp(r.Context(), container, op)
+	recordTiming(r, "backend", time.Since(backendStart))
+	if err != nil {
+		status = errorStatus(err)
+	}
+	auditContainerOp(r, container, op, status, err)
+	if err != nil {
+		logRequest(r, "%v (using the %s backend)", err, suspendResumeOps.Name())
+	} else {
+		logRequestDebug(r, "%s %s succeeded", verb, container)
+	}
+	return "", err
+}
+
+// Shared implementation of the /suspend and /resume routes.
 // The container was given as part of the URL; gorilla makes it available in vars["container"]
-func resumeUserAction(w http.ResponseWriter, r *http.Request) {
+func handleContainerOp(w http.ResponseWriter, r *http.Request, op string, verb string, timingName string) {
 	var start time.Time
 	if timeOps {
 		start = time.Now()
@@ -57,95 +609,1154 @@ func resumeUserAction(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	container := vars["container"]
-	dummy := strings.NewReader("")
-	resp, err := client.Post("http://localhost/containers/"+container+"/unpause", "text/plain", dummy)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Unpausing %s failed with error: %v\n", container, err)
-	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		w.WriteHeader(500)
-		fmt.Fprint(w, "Unpausing %s failed with status code: %d\n", container, resp.StatusCode)
+	if id, err := executeContainerOp(r, container, op, verb, 204); err != nil {
+		writeOpError(w, err)
+	} else if id != "" {
+		w.Header().Set("Location", "/operations/"+id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
 	} else {
 		w.WriteHeader(204) // success!
 	}
 
-	if timeOps {
+	if timeOps && timeOpsStdout {
 		end := time.Now()
 		elapsed := end.Sub(start)
-		fmt.Fprintf(os.Stdout, "Unpause took %s\n", elapsed.String())
+		logRequest(r, "%s took %s", timingName, elapsed.String())
 	}
 }
 
 // handler for /resume/<container> route
-// The container was given as part of the URL; gorilla makes it available in vars["container"]
+func resumeUserAction(w http.ResponseWriter, r *http.Request) {
+	handleContainerOp(w, r, "unpause", "Unpausing", "Unpause")
+}
+
+// handler for /suspend/<container> route
 func suspendUserAction(w http.ResponseWriter, r *http.Request) {
-	var start time.Time
-	if timeOps {
-		start = time.Now()
+	handleContainerOp(w, r, "pause", "Pausing", "Pause")
+}
+
+/*
+ * Audit trail of container operations
+ */
+
+/* Open audit file, or nil if auditing is disabled */
+var auditLog = struct {
+	sync.Mutex
+	file *os.File
+}{}
+
+/* One line of the audit file */
+type auditEntry struct {
+	Time         string `json:"time"`
+	Container    string `json:"container"`
+	Operation    string `json:"operation"`
+	Backend      string `json:"backend"`
+	Outcome      string `json:"outcome"`
+	Status       int    `json:"status"`
+	Error        string `json:"error,omitempty"`
+	Caller       string `json:"caller"`
+	ActivationId string `json:"activationId"`
+}
+
+// Open auditFile for appending, if configured
+func openAuditLog() error {
+	if auditFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("Unable to open audit file %s; error was %v", auditFile, err)
+	}
+	auditLog.file = f
+	return nil
+}
+
+// Record that op was performed on container on behalf of r, with result err.
+// status is the status the caller was sent.
+func auditContainerOp(r *http.Request, container string, op string, status int, err error) {
+	if auditLog.file == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:         time.Now().UTC().Format(time.RFC3339Nano),
+		Container:    container,
+		Operation:    op,
+		Backend:      suspendResumeOps.Name(),
+		Outcome:      "success",
+		Status:       status,
+		Caller:       clientAddr(r),
+		ActivationId: activationId(r),
+	}
+	if err != nil {
+		entry.Outcome = "failure"
+		entry.Error = err.Error()
 	}
+	line, _ := json.Marshal(entry)
 
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if _, werr := auditLog.file.Write(append(line, '\n')); werr != nil {
+		fmt.Fprintf(os.Stderr, "Writing to audit file %s failed with error: %v\n", auditFile, werr)
+	}
+}
+
+/*
+ * Per-container rate limiting of suspend/resume operations
+ */
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/* Token buckets by container; a bucket that has refilled completely is equivalent to none */
+var containerBuckets = struct {
+	sync.Mutex
+	m map[string]*tokenBucket
+}{m: make(map[string]*tokenBucket)}
+
+// Refill b as of now
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(containerOpBurst), b.tokens+now.Sub(b.last).Seconds()*containerOpRate)
+	b.last = now
+}
+
+// Take a token from container's bucket, returning 0 on success or else how
+// long the caller should wait before retrying. Always succeeds if
+// containerOpRate is 0 (rate limiting disabled).
+func takeContainerToken(container string, now time.Time) time.Duration {
+	if containerOpRate <= 0 {
+		return 0
+	}
+	containerBuckets.Lock()
+	defer containerBuckets.Unlock()
+
+	if len(containerBuckets.m) > 1024 {
+		for c, b := range containerBuckets.m {
+			if b.refill(now); b.tokens >= float64(containerOpBurst) {
+				delete(containerBuckets.m, c)
+			}
+		}
+	}
+
+	b, ok := containerBuckets.m[container]
+	if !ok {
+		b = &tokenBucket{tokens: float64(containerOpBurst), last: now}
+		containerBuckets.m[container] = b
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / containerOpRate * float64(time.Second))
+}
+
+/*
+ * Support for the consolidated /op route
+ */
+
+/* Body of a /op request */
+type opRequest struct {
+	Op        string `json:"op"`
+	Container string `json:"container"`
+}
+
+/* Body of a /op response */
+type opResult struct {
+	Op          string `json:"op"`
+	Container   string `json:"container"`
+	Status      int    `json:"status"`
+	OperationId string `json:"operationId,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+/* Operations accepted by /op, mapped to the docker operation and verb performing them */
+var opRoutes = map[string]struct{ op, verb string }{
+	"suspend": {"pause", "Pausing"},
+	"resume":  {"unpause", "Unpausing"},
+}
+
+// handler for /op route
+// Performs the operation named in the JSON request body, eg {"op":"suspend","container":"..."}
+func handleOpRequest(w http.ResponseWriter, r *http.Request) {
+	var req opRequest
+	result := opResult{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		result.Status = 400
+		result.Error = fmt.Sprintf("Invalid request body: %v", err)
+	} else if route, ok := opRoutes[req.Op]; !ok {
+		result.Status = 400
+		result.Error = fmt.Sprintf("Invalid op %q; must be suspend or resume", req.Op)
+	} else if req.Container == "" {
+		result.Status = 400
+		result.Error = "Missing container"
+	} else if id, err := executeContainerOp(r, req.Container, route.op, route.verb, 200); err != nil {
+		result.Status = opErrorStatus(w, err)
+		result.Error = err.Error()
+	} else if id != "" {
+		result.Status = 202
+		result.OperationId = id
+		w.Header().Set("Location", "/operations/"+id)
+	} else {
+		result.Status = 200
+	}
+	result.Op = req.Op
+	result.Container = req.Container
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.Status)
+	json.NewEncoder(w).Encode(result)
+}
+
+/*
+ * Support for asynchronous suspend/resume operations
+ */
+
+const (
+	opAccepted   = "accepted"
+	opInProgress = "in-progress"
+	opDone       = "done"
+	opFailed     = "failed"
+)
+
+// State of an asynchronous container operation, as reported by /operations/<id>
+type operation struct {
+	Id        string `json:"id"`
+	Op        string `json:"op"`
+	Container string `json:"container"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	expires   time.Time
+}
+
+/* Registry of asynchronous operations; entries expire operationTTL after completion */
+var operations = struct {
+	sync.Mutex
+	m map[string]*operation
+}{m: make(map[string]*operation)}
+
+// Remove expired operations; caller must hold operations' lock
+func expireOperations(now time.Time) {
+	for id, o := range operations.m {
+		if !o.expires.IsZero() && now.After(o.expires) {
+			delete(operations.m, id)
+		}
+	}
+}
+
+func setOperationStatus(o *operation, status string, err error) {
+	operations.Lock()
+	defer operations.Unlock()
+	o.Status = status
+	if err != nil {
+		o.Error = err.Error()
+	}
+	if status == opDone || status == opFailed {
+		o.expires = time.Now().Add(operationTTL)
+	}
+}
+
+// Register a new operation and run it in the background, returning its id.
+// The operation outlives r, so it is not bound to r's context.
+func startAsyncOperation(r *http.Request, container string, op string) string {
+	o := &operation{Id: generateId(), Op: op, Container: container, Status: opAccepted}
+	operations.Lock()
+	expireOperations(time.Now())
+	operations.m[o.Id] = o
+	operations.Unlock()
+
+	go func() {
+		ctx := context.Background()
+		if requestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+			defer cancel()
+		}
+		setOperationStatus(o, opInProgress, nil)
+		err := performContainerOp(ctx, container, op)
+		// The caller was sent 202 whatever the outcome
+		auditContainerOp(r, container, op, 202, err)
+		if err != nil {
+			logRequest(r, "%v (using the %s backend)", err, suspendResumeOps.Name())
+			setOperationStatus(o, opFailed, err)
+		} else {
+			setOperationStatus(o, opDone, nil)
+		}
+	}()
+	return o.Id
+}
+
+// handler for /operations/<id> route
+func getOperation(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	container := vars["container"]
-	dummy := strings.NewReader("")
-	resp, err := client.Post("http://localhost/containers/"+container+"/pause", "text/plain", dummy)
+	id := vars["id"]
+	operations.Lock()
+	expireOperations(time.Now())
+	o, ok := operations.m[id]
+	var snapshot operation
+	if ok {
+		snapshot = *o
+	}
+	operations.Unlock()
+
+	if !ok {
+		writeError(w, 404, fmt.Sprintf("Unknown operation %s", id))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+/*
+ * Support for listing paused containers
+ */
+
+// handler for /paused route
+// Responds with a JSON array of the ids of all paused containers.
+// The cgroup backend freezes containers behind the runtime's back, so with
+// it the freezer state of each running container is read instead.
+func listPausedContainers(w http.ResponseWriter, r *http.Request) {
+	filters := url.QueryEscape(`{"status":["paused"]}`)
+	if containerRuntime == "cgroup" {
+		filters = url.QueryEscape(`{"status":["running","paused"]}`)
+	}
+	resp, err := dockerRequest(r.Context(), "GET", "/containers/json?filters="+filters)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Pausing %s failed with error: %v\n", container, err)
-	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		w.WriteHeader(500)
-		fmt.Fprint(w, "Pausing %s failed with status code: %d\n", container, resp.StatusCode)
+		logRequest(r, "Listing paused containers failed with error: %v", err)
+		writeError(w, transportErrorStatus(r.Context(), err), fmt.Sprintf("Listing paused containers failed with error: %v", err))
+		return
+	}
+	defer drainAndClose(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logRequest(r, "Listing paused containers failed with status code: %d", resp.StatusCode)
+		writeError(w, 500, fmt.Sprintf("Listing paused containers failed with status code: %d", resp.StatusCode))
+		return
+	}
+	var containers []struct{ Id string }
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		writeError(w, 500, fmt.Sprintf("Listing paused containers failed: unable to parse docker response: %v", err))
+		return
+	}
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		if containerRuntime == "cgroup" {
+			frozen, err := isCgroupFrozen(c.Id)
+			if err == errNoCgroup {
+				// Exited since docker listed it
+				continue
+			} else if err != nil {
+				logRequest(r, "Listing paused containers failed: unable to read the freezer state of %s: %v", c.Id, err)
+				writeError(w, 500, fmt.Sprintf("Listing paused containers failed: unable to read the freezer state of %s: %v", c.Id, err))
+				return
+			}
+			if !frozen {
+				continue
+			}
+		}
+		ids = append(ids, c.Id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ids)
+}
+
+/*
+ * Support for an operator kill switch for suspend/resume
+ */
+
+/* Are suspend/resume currently refused? Toggled by /admin/disable and /admin/enable; not persisted */
+var containerOpsDisabled atomic.Bool
+
+// Middleware admitting only requests bearing adminToken
+func withAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			logRequest(r, "Rejected admin request from %s: missing or invalid token", clientAddr(r))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, 401, "missing or invalid admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handler for /admin/disable route
+func disableContainerOps(w http.ResponseWriter, r *http.Request) {
+	containerOpsDisabled.Store(true)
+	logRequest(r, "Suspend/resume disabled by an operator at %s", clientAddr(r))
+	w.WriteHeader(204)
+}
+
+// handler for /admin/enable route
+func enableContainerOps(w http.ResponseWriter, r *http.Request) {
+	containerOpsDisabled.Store(false)
+	logRequest(r, "Suspend/resume enabled by an operator at %s", clientAddr(r))
+	w.WriteHeader(204)
+}
+
+/*
+ * Support for identifying clients behind trusted proxies
+ */
+
+// Is ip within one of trustedProxies?
+func isTrustedProxy(ip net.IP) bool {
+	for _, cidr := range trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The IP address of the client making r.
+// X-Forwarded-For is believed only as far as trusted proxies appended to
+// it: starting from the direct peer, each trusted hop is replaced by the
+// address it forwarded for, and the first untrusted address is the client.
+// This keeps clients from spoofing their address through the header.
+func clientAddr(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(client)
+		if ip == nil || !isTrustedProxy(ip) {
+			break
+		}
+		client = hops[i]
+	}
+	return client
+}
+
+/*
+ * Support for reporting latency percentiles of container operations
+ */
+
+/* Number of most recent latencies kept per op */
+const latencySamples = 1024
+
+/* The latest backend latencies per op (pause/unpause), if latencyHistogram */
+var opLatencies = struct {
+	sync.Mutex
+	m map[string]*latencyRing
+}{m: make(map[string]*latencyRing)}
+
+type latencyRing struct {
+	samples []time.Duration
+	next    int   // index overwritten next, once samples is full
+	count   int64 // all latencies ever recorded
+}
+
+// Record the latency of an op started at start
+func recordOpLatency(op string, start time.Time) {
+	elapsed := time.Since(start)
+	opLatencies.Lock()
+	defer opLatencies.Unlock()
+	ring := opLatencies.m[op]
+	if ring == nil {
+		ring = &latencyRing{}
+		opLatencies.m[op] = ring
+	}
+	if len(ring.samples) < latencySamples {
+		ring.samples = append(ring.samples, elapsed)
 	} else {
-		w.WriteHeader(204) // success!
+		ring.samples[ring.next] = elapsed
+		ring.next = (ring.next + 1) % latencySamples
 	}
+	ring.count++
+}
 
-	if timeOps {
-		end := time.Now()
-		elapsed := end.Sub(start)
-		fmt.Fprintf(os.Stdout, "Pause took %s\n", elapsed.String())
+// The nearest-rank p-th percentile of sorted, in milliseconds
+func percentileMillis(sorted []time.Duration, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return float64(sorted[rank-1]) / float64(time.Millisecond)
+}
+
+// Latency percentiles per op, published in /metrics as opLatency
+func opLatencySummary() interface{} {
+	opLatencies.Lock()
+	defer opLatencies.Unlock()
+	summary := map[string]interface{}{"backend": suspendResumeOps.Name()}
+	for op, ring := range opLatencies.m {
+		sorted := append([]time.Duration(nil), ring.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		summary[op] = map[string]interface{}{
+			"count":  ring.count,
+			"p50_ms": percentileMillis(sorted, 50),
+			"p99_ms": percentileMillis(sorted, 99),
+		}
+	}
+	return summary
+}
+
+/*
+ * Support for inspecting the effective configuration
+ */
+
+// Replace a secret setting with a marker showing only whether it is set
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+func patternString(pattern *regexp.Regexp) string {
+	if pattern == nil {
+		return ""
+	}
+	return pattern.String()
+}
+
+func cidrStrings(cidrs []*net.IPNet) []string {
+	strs := []string{}
+	for _, cidr := range cidrs {
+		strs = append(strs, cidr.String())
 	}
+	return strs
+}
+
+// The effective configuration, keyed as in the config file, with secrets redacted
+func effectiveConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"time_ops":                    timeOps,
+		"time_ops_stdout":             timeOpsStdout,
+		"runtime":                     containerRuntime,
+		"docker_sock":                 dockerSock,
+		"docker_sock_fallback":        dockerSockFallback,
+		"docker_tcp_address":          dockerTcpAddress,
+		"docker_tls_ca":               dockerTlsCa,
+		"docker_tls_cert":             dockerTlsCert,
+		"docker_tls_key":              redact(dockerTlsKey),
+		"container_dir":               containerDir,
+		"port":                        invokerAgentPort,
+		"bind_address":                bindAddress,
+		"server_read_timeout":         serverReadTimeout.String(),
+		"server_write_timeout":        serverWriteTimeout.String(),
+		"server_idle_timeout":         serverIdleTimeout.String(),
+		"pprof":                       pprofEnabled,
+		"pprof_port":                  pprofPort,
+		"pprof_bind_address":          pprofBindAddress,
+		"gogc":                        gcPercent,
+		"memory_limit":                memoryLimit,
+		"request_timeout":             requestTimeout.String(),
+		"async_ops":                   asyncOps,
+		"operation_ttl":               operationTTL.String(),
+		"max_docker_conns":            maxDockerConns,
+		"docker_retry_after":          dockerRetryAfter.String(),
+		"docker_dial_timeout":         dockerDialTimeout.String(),
+		"docker_timeout":              dockerTimeout.String(),
+		"error_format":                errorFormat,
+		"container_op_rate":           containerOpRate,
+		"container_op_burst":          containerOpBurst,
+		"audit_file":                  auditFile,
+		"log_level":                   logLevel,
+		"exited_container_status":     exitedContainerStatus,
+		"container_allow_pattern":     patternString(containerAllowPattern),
+		"verify_openwhisk_containers": verifyOpenWhiskContainers,
+		"openwhisk_name_prefix":       openwhiskNamePrefix,
+		"openwhisk_label":             openwhiskLabel,
+		"admin_token":                 redact(adminToken),
+		"trusted_proxies":             cidrStrings(trustedProxies),
+		"cgroup_path_template":        cgroupPathTemplate,
+		"latency_histogram":           latencyHistogram,
+		"breaker_threshold":           breakerThreshold,
+		"breaker_cooldown":            breakerCooldown.String(),
+	}
+}
+
+// handler for /config route
+func getEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effectiveConfig())
+}
+
+/*
+ * Support for readiness probes
+ */
+
+// handler for /ready route
+// The agent is ready only if it can reach the docker daemon it proxies to.
+func readinessCheck(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	resp, err := dockerRequest(ctx, "GET", "/_ping")
+	if err != nil {
+		writeError(w, 503, fmt.Sprintf("Not ready: docker daemon unreachable: %v", err))
+		return
+	}
+	drainAndClose(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		writeError(w, 503, fmt.Sprintf("Not ready: docker ping returned status code: %d", resp.StatusCode))
+		return
+	}
+	w.WriteHeader(200)
+	fmt.Fprintln(w, "OK")
 }
 
 /*
  * Initialization and main function
  */
 
-// Process configuration overrides from environment
-func initializeFromEnv() {
+/* Settings read from INVOKER_AGENT_CONFIG_FILE, keyed by envvar name */
+var fileConfig = make(map[string]string)
+
+/* Keys of fileConfig that have been consulted, to detect unknown keys */
+var usedFileConfig = make(map[string]bool)
+
+// Load INVOKER_AGENT_CONFIG_FILE, a YAML (or JSON) mapping of settings.
+// Keys are the envvar names without the INVOKER_AGENT_ prefix, in any case
+// (eg "port" or "DOCKER_SOCK").
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read config file %s; error was %v", path, err)
+	}
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("Invalid config file %s; error was %v", path, err)
+	}
+	for key, value := range settings {
+		if value == nil {
+			continue
+		}
+		fileConfig["INVOKER_AGENT_"+strings.ToUpper(key)] = fmt.Sprint(value)
+	}
+	return nil
+}
+
+// The value of configuration setting name (an envvar name).
+// The environment overrides the config file; "" means use the built-in default.
+func getConfig(name string) string {
+	usedFileConfig[name] = true
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fileConfig[name]
+}
+
+// Process configuration overrides from the config file and environment
+func initializeFromEnv() error {
 	var err error
-	if os.Getenv("INVOKER_AGENT_DOCKER_SOCK") != "" {
-		dockerSock = os.Getenv("INVOKER_AGENT_DOCKER_SOCK")
+	if os.Getenv("INVOKER_AGENT_CONFIG_FILE") != "" {
+		if err := loadConfigFile(os.Getenv("INVOKER_AGENT_CONFIG_FILE")); err != nil {
+			return err
+		}
+	}
+	if getConfig("INVOKER_AGENT_RUNTIME") != "" {
+		containerRuntime = getConfig("INVOKER_AGENT_RUNTIME")
+		if containerRuntime != "docker" && containerRuntime != "podman" && containerRuntime != "cgroup" {
+			return fmt.Errorf("Invalid INVOKER_AGENT_RUNTIME %s; must be docker, podman or cgroup", containerRuntime)
+		}
+	}
+	// DOCKER_HOST is read only from the environment, so like any other
+	// environment setting it overrides docker_sock in the config file
+	if os.Getenv("INVOKER_AGENT_DOCKER_SOCK") == "" && os.Getenv("DOCKER_HOST") != "" {
+		usedFileConfig["INVOKER_AGENT_DOCKER_SOCK"] = true
+		if err := parseDockerHost(os.Getenv("DOCKER_HOST")); err != nil {
+			return err
+		}
+	} else if getConfig("INVOKER_AGENT_DOCKER_SOCK") != "" {
+		dockerSock = getConfig("INVOKER_AGENT_DOCKER_SOCK")
+	}
+	if getConfig("INVOKER_AGENT_DOCKER_SOCK_FALLBACK") != "" {
+		dockerSockFallback = getConfig("INVOKER_AGENT_DOCKER_SOCK_FALLBACK")
+	}
+	if getConfig("INVOKER_AGENT_DOCKER_TCP_ADDRESS") != "" {
+		dockerTcpAddress = getConfig("INVOKER_AGENT_DOCKER_TCP_ADDRESS")
 	}
-	if os.Getenv("INVOKER_AGENT_CONTAINER_DIR") != "" {
-		containerDir = os.Getenv("INVOKER_AGENT_CONTAINER_DIR")
+	if getConfig("INVOKER_AGENT_DOCKER_TLS_CA") != "" {
+		dockerTlsCa = getConfig("INVOKER_AGENT_DOCKER_TLS_CA")
 	}
-	if os.Getenv("INVOKER_AGENT_PORT") != "" {
-		str := os.Getenv("INVOKER_AGENT_PORT")
+	if getConfig("INVOKER_AGENT_DOCKER_TLS_CERT") != "" {
+		dockerTlsCert = getConfig("INVOKER_AGENT_DOCKER_TLS_CERT")
+	}
+	if getConfig("INVOKER_AGENT_DOCKER_TLS_KEY") != "" {
+		dockerTlsKey = getConfig("INVOKER_AGENT_DOCKER_TLS_KEY")
+	}
+	if (dockerTlsCert == "") != (dockerTlsKey == "") {
+		return fmt.Errorf("INVOKER_AGENT_DOCKER_TLS_CERT and INVOKER_AGENT_DOCKER_TLS_KEY must be given together")
+	}
+	if dockerTcpAddress == "" && (dockerTlsCa != "" || dockerTlsCert != "") {
+		return fmt.Errorf("Docker TLS settings require a TCP docker endpoint")
+	}
+	if getConfig("INVOKER_AGENT_CONTAINER_DIR") != "" {
+		containerDir = getConfig("INVOKER_AGENT_CONTAINER_DIR")
+	}
+	if getConfig("INVOKER_AGENT_BIND_ADDRESS") != "" {
+		// Accept IPv6 literals with or without brackets
+		bindAddress = strings.TrimSuffix(strings.TrimPrefix(getConfig("INVOKER_AGENT_BIND_ADDRESS"), "["), "]")
+	}
+	if getConfig("INVOKER_AGENT_AUDIT_FILE") != "" {
+		auditFile = getConfig("INVOKER_AGENT_AUDIT_FILE")
+	}
+	if getConfig("INVOKER_AGENT_LOG_LEVEL") != "" {
+		logLevel = getConfig("INVOKER_AGENT_LOG_LEVEL")
+		if logLevel != "info" && logLevel != "debug" {
+			return fmt.Errorf("Invalid INVOKER_AGENT_LOG_LEVEL %s; must be info or debug", logLevel)
+		}
+	}
+	if getConfig("INVOKER_AGENT_EXITED_CONTAINER_STATUS") != "" {
+		str := getConfig("INVOKER_AGENT_EXITED_CONTAINER_STATUS")
+		exitedContainerStatus, err = strconv.Atoi(str)
+		if err != nil || exitedContainerStatus < 400 || exitedContainerStatus > 599 {
+			return fmt.Errorf("Invalid INVOKER_AGENT_EXITED_CONTAINER_STATUS %s; must be an HTTP error status", str)
+		}
+	}
+	if getConfig("INVOKER_AGENT_CONTAINER_ALLOW_PATTERN") != "" {
+		str := getConfig("INVOKER_AGENT_CONTAINER_ALLOW_PATTERN")
+		// The pattern must match the whole name, so "wsk.*" does not admit "notwsk0"
+		containerAllowPattern, err = regexp.Compile("^(?:" + str + ")$")
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_CONTAINER_ALLOW_PATTERN %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_TIME_OPS") != "" {
+		str := getConfig("INVOKER_AGENT_TIME_OPS")
+		timeOps, err = strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_TIME_OPS %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_TIME_OPS_STDOUT") != "" {
+		str := getConfig("INVOKER_AGENT_TIME_OPS_STDOUT")
+		timeOpsStdout, err = strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_TIME_OPS_STDOUT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_PORT") != "" {
+		str := getConfig("INVOKER_AGENT_PORT")
 		invokerAgentPort, err = strconv.Atoi(str)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid INVOKER_AGENT_PORT %s; error was %v\n", str, err)
-			panic(err)
+			return fmt.Errorf("Invalid INVOKER_AGENT_PORT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_SERVER_READ_TIMEOUT") != "" {
+		str := getConfig("INVOKER_AGENT_SERVER_READ_TIMEOUT")
+		serverReadTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_SERVER_READ_TIMEOUT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_SERVER_WRITE_TIMEOUT") != "" {
+		str := getConfig("INVOKER_AGENT_SERVER_WRITE_TIMEOUT")
+		serverWriteTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_SERVER_WRITE_TIMEOUT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_SERVER_IDLE_TIMEOUT") != "" {
+		str := getConfig("INVOKER_AGENT_SERVER_IDLE_TIMEOUT")
+		serverIdleTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_SERVER_IDLE_TIMEOUT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_PPROF") != "" {
+		str := getConfig("INVOKER_AGENT_PPROF")
+		pprofEnabled, err = strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_PPROF %s; error was %v", str, err)
 		}
 	}
+	if getConfig("INVOKER_AGENT_PPROF_BIND_ADDRESS") != "" {
+		pprofBindAddress = strings.TrimSuffix(strings.TrimPrefix(getConfig("INVOKER_AGENT_PPROF_BIND_ADDRESS"), "["), "]")
+	}
+	if getConfig("INVOKER_AGENT_PPROF_PORT") != "" {
+		str := getConfig("INVOKER_AGENT_PPROF_PORT")
+		pprofPort, err = strconv.Atoi(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_PPROF_PORT %s; error was %v", str, err)
+		}
+	}
+	if pprofEnabled && pprofPort == invokerAgentPort {
+		return fmt.Errorf("INVOKER_AGENT_PPROF_PORT must differ from INVOKER_AGENT_PORT")
+	}
+	if getConfig("INVOKER_AGENT_GOGC") != "" {
+		str := getConfig("INVOKER_AGENT_GOGC")
+		gcPercent, err = strconv.Atoi(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_GOGC %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_MEMORY_LIMIT") != "" {
+		str := getConfig("INVOKER_AGENT_MEMORY_LIMIT")
+		memoryLimit, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_MEMORY_LIMIT %s; error was %v", str, err)
+		}
+		if memoryLimit <= 0 {
+			return fmt.Errorf("Invalid INVOKER_AGENT_MEMORY_LIMIT %s; must be positive", str)
+		}
+	}
+	if getConfig("INVOKER_AGENT_REQUEST_TIMEOUT") != "" {
+		str := getConfig("INVOKER_AGENT_REQUEST_TIMEOUT")
+		requestTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_REQUEST_TIMEOUT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_ASYNC_OPS") != "" {
+		str := getConfig("INVOKER_AGENT_ASYNC_OPS")
+		asyncOps, err = strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_ASYNC_OPS %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_OPERATION_TTL") != "" {
+		str := getConfig("INVOKER_AGENT_OPERATION_TTL")
+		operationTTL, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_OPERATION_TTL %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_MAX_DOCKER_CONNS") != "" {
+		str := getConfig("INVOKER_AGENT_MAX_DOCKER_CONNS")
+		maxDockerConns, err = strconv.Atoi(str)
+		if err != nil || maxDockerConns < 0 {
+			return fmt.Errorf("Invalid INVOKER_AGENT_MAX_DOCKER_CONNS %s; must be a non-negative integer", str)
+		}
+	}
+	if getConfig("INVOKER_AGENT_DOCKER_RETRY_AFTER") != "" {
+		str := getConfig("INVOKER_AGENT_DOCKER_RETRY_AFTER")
+		dockerRetryAfter, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_DOCKER_RETRY_AFTER %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_VERIFY_OPENWHISK_CONTAINERS") != "" {
+		str := getConfig("INVOKER_AGENT_VERIFY_OPENWHISK_CONTAINERS")
+		verifyOpenWhiskContainers, err = strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_VERIFY_OPENWHISK_CONTAINERS %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_OPENWHISK_NAME_PREFIX") != "" {
+		openwhiskNamePrefix = getConfig("INVOKER_AGENT_OPENWHISK_NAME_PREFIX")
+	}
+	if getConfig("INVOKER_AGENT_OPENWHISK_LABEL") != "" {
+		openwhiskLabel = getConfig("INVOKER_AGENT_OPENWHISK_LABEL")
+	}
+	if getConfig("INVOKER_AGENT_ADMIN_TOKEN") != "" {
+		adminToken = getConfig("INVOKER_AGENT_ADMIN_TOKEN")
+	}
+	if getConfig("INVOKER_AGENT_TRUSTED_PROXIES") != "" {
+		str := getConfig("INVOKER_AGENT_TRUSTED_PROXIES")
+		for _, cidr := range strings.Split(str, ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return fmt.Errorf("Invalid INVOKER_AGENT_TRUSTED_PROXIES %s; error was %v", str, err)
+			}
+			trustedProxies = append(trustedProxies, ipNet)
+		}
+	}
+	if getConfig("INVOKER_AGENT_CGROUP_PATH_TEMPLATE") != "" {
+		cgroupPathTemplate = getConfig("INVOKER_AGENT_CGROUP_PATH_TEMPLATE")
+	}
+	if getConfig("INVOKER_AGENT_BREAKER_THRESHOLD") != "" {
+		str := getConfig("INVOKER_AGENT_BREAKER_THRESHOLD")
+		breakerThreshold, err = strconv.Atoi(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_BREAKER_THRESHOLD %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_BREAKER_COOLDOWN") != "" {
+		str := getConfig("INVOKER_AGENT_BREAKER_COOLDOWN")
+		breakerCooldown, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_BREAKER_COOLDOWN %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_LATENCY_HISTOGRAM") != "" {
+		str := getConfig("INVOKER_AGENT_LATENCY_HISTOGRAM")
+		latencyHistogram, err = strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_LATENCY_HISTOGRAM %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_DOCKER_DIAL_TIMEOUT") != "" {
+		str := getConfig("INVOKER_AGENT_DOCKER_DIAL_TIMEOUT")
+		dockerDialTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_DOCKER_DIAL_TIMEOUT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_DOCKER_TIMEOUT") != "" {
+		str := getConfig("INVOKER_AGENT_DOCKER_TIMEOUT")
+		dockerTimeout, err = time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("Invalid INVOKER_AGENT_DOCKER_TIMEOUT %s; error was %v", str, err)
+		}
+	}
+	if getConfig("INVOKER_AGENT_ERROR_FORMAT") != "" {
+		errorFormat = getConfig("INVOKER_AGENT_ERROR_FORMAT")
+		if errorFormat != "plain" && errorFormat != "json" && errorFormat != "problem" {
+			return fmt.Errorf("Invalid INVOKER_AGENT_ERROR_FORMAT %s; must be plain, json or problem", errorFormat)
+		}
+	}
+	if getConfig("INVOKER_AGENT_CONTAINER_OP_RATE") != "" {
+		str := getConfig("INVOKER_AGENT_CONTAINER_OP_RATE")
+		containerOpRate, err = strconv.ParseFloat(str, 64)
+		if err != nil || containerOpRate < 0 {
+			return fmt.Errorf("Invalid INVOKER_AGENT_CONTAINER_OP_RATE %s; must be a non-negative number", str)
+		}
+	}
+	if getConfig("INVOKER_AGENT_CONTAINER_OP_BURST") != "" {
+		str := getConfig("INVOKER_AGENT_CONTAINER_OP_BURST")
+		containerOpBurst, err = strconv.Atoi(str)
+		if err != nil || containerOpBurst < 1 {
+			return fmt.Errorf("Invalid INVOKER_AGENT_CONTAINER_OP_BURST %s; must be a positive integer", str)
+		}
+	}
+	for key := range fileConfig {
+		if !usedFileConfig[key] {
+			return fmt.Errorf("Unknown setting %s in config file", strings.TrimPrefix(key, "INVOKER_AGENT_"))
+		}
+	}
+	return nil
 }
 
-func handleRequests() {
+// Configure the docker endpoint from a DOCKER_HOST style url
+// (unix:///var/run/docker.sock or tcp://host:port)
+func parseDockerHost(dockerHost string) error {
+	u, err := url.Parse(dockerHost)
+	if err != nil {
+		return fmt.Errorf("Invalid DOCKER_HOST %s; error was %v", dockerHost, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return fmt.Errorf("Invalid DOCKER_HOST %s; missing socket path", dockerHost)
+		}
+		dockerSock = u.Path
+	case "tcp":
+		if u.Host == "" {
+			return fmt.Errorf("Invalid DOCKER_HOST %s; missing host", dockerHost)
+		}
+		dockerTcpAddress = u.Host
+	default:
+		return fmt.Errorf("Invalid DOCKER_HOST %s; unsupported scheme %s", dockerHost, u.Scheme)
+	}
+	return nil
+}
+
+// Apply the configured garbage collector tuning.
+// A setting that was not given leaves the runtime's own (eg from GOGC or
+// GOMEMLIMIT) in place, and is updated to it so /config reports it.
+func configureGC() {
+	if getConfig("INVOKER_AGENT_GOGC") != "" {
+		debug.SetGCPercent(gcPercent)
+	} else {
+		gcPercent = debug.SetGCPercent(gcPercent)
+		debug.SetGCPercent(gcPercent)
+	}
+	if getConfig("INVOKER_AGENT_MEMORY_LIMIT") != "" {
+		debug.SetMemoryLimit(memoryLimit)
+	} else {
+		memoryLimit = debug.SetMemoryLimit(-1)
+	}
+}
+
+// Open http client to dockerSock (or dockerTcpAddress, if set).
+// A connection that cannot be made to dockerSock is retried on dockerSockFallback.
+func newDockerSockHttpClient() (*http.Client, error) {
+	dialer := &net.Dialer{Timeout: dockerDialTimeout}
+	fd := func(ctx context.Context, proto, addr string) (conn net.Conn, err error) {
+		if dockerTcpAddress != "" {
+			return dialer.DialContext(ctx, "tcp", dockerTcpAddress)
+		}
+		conn, err = dialer.DialContext(ctx, "unix", dockerSock)
+		if err != nil && dockerSockFallback != "" && ctx.Err() == nil {
+			dockerFallbackDials.Add(1)
+			fmt.Fprintf(os.Stdout, "Unable to connect to docker at %s (%v); trying %s\n", dockerSock, err, dockerSockFallback)
+			conn, err = dialer.DialContext(ctx, "unix", dockerSockFallback)
+		}
+		return conn, err
+	}
+	tr := &http.Transport{
+		DialContext:     fd,
+		MaxConnsPerHost: maxDockerConns,
+	}
+	if useDockerTls() {
+		tlsConfig, err := dockerTlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: tr, Timeout: dockerTimeout}, nil
+}
+
+// Is the docker endpoint reached over TLS?
+func useDockerTls() bool {
+	return dockerTcpAddress != "" && (dockerTlsCa != "" || dockerTlsCert != "")
+}
+
+// Build the TLS configuration for a TCP docker endpoint
+func dockerTlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(dockerTcpAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid docker TCP address %s; error was %v", dockerTcpAddress, err)
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if dockerTlsCa != "" {
+		pem, err := os.ReadFile(dockerTlsCa)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read docker TLS CA %s; error was %v", dockerTlsCa, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in docker TLS CA %s", dockerTlsCa)
+		}
+	}
+	if dockerTlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(dockerTlsCert, dockerTlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load docker TLS certificate %s; error was %v", dockerTlsCert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Build the router serving all of the agent's routes
+func newRouter() *mux.Router {
 	myRouter := mux.NewRouter().StrictSlash(true)
 	myRouter.HandleFunc("/suspend/{container}", suspendUserAction)
 	myRouter.HandleFunc("/resume/{container}", resumeUserAction)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", invokerAgentPort), myRouter))
+	myRouter.HandleFunc("/op", handleOpRequest).Methods("POST")
+	myRouter.HandleFunc("/operations/{id}", getOperation).Methods("GET")
+	myRouter.HandleFunc("/paused", listPausedContainers).Methods("GET")
+	myRouter.HandleFunc("/ready", readinessCheck)
+	myRouter.HandleFunc("/config", getEffectiveConfig).Methods("GET")
+	myRouter.Handle("/metrics", expvar.Handler())
+	if adminToken != "" {
+		myRouter.HandleFunc("/admin/disable", withAdminToken(disableContainerOps)).Methods("POST")
+		myRouter.HandleFunc("/admin/enable", withAdminToken(enableContainerOps)).Methods("POST")
+	}
+	myRouter.Use(withActivationId)
+	myRouter.Use(withServerTiming)
+	myRouter.Use(withRequestTimeout)
+	return myRouter
+}
+
+// Build the mux serving the profiling endpoints.
+// It is kept separate from the main router so profiles are never exposed on the agent's port.
+func newPprofMux() *http.ServeMux {
+	pprofMux := http.NewServeMux()
+	pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+	pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return pprofMux
+}
+
+// Serve the profiling endpoints on pprofBindAddress, if enabled.
+// Returns the listener, or nil if profiling is disabled.
+func startPprof() (net.Listener, error) {
+	if !pprofEnabled {
+		return nil, nil
+	}
+	pprofAddress := net.JoinHostPort(pprofBindAddress, strconv.Itoa(pprofPort))
+	pprofListener, err := net.Listen("tcp", pprofAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %s; error was %v", pprofAddress, err)
+	}
+	go func() {
+		if err := http.Serve(pprofListener, newPprofMux()); !errors.Is(err, net.ErrClosed) {
+			log.Fatal(err)
+		}
+	}()
+	return pprofListener, nil
+}
+
+// Listen on bindAddress and invokerAgentPort for the agent's routes
+func listenAgent() (net.Listener, error) {
+	listenAddress := net.JoinHostPort(bindAddress, strconv.Itoa(invokerAgentPort))
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %s; error was %v", listenAddress, err)
+	}
+	return listener, nil
+}
+
+// Build the agent's http server, configured with the server timeouts
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  serverReadTimeout,
+		WriteTimeout: serverWriteTimeout,
+		IdleTimeout:  serverIdleTimeout,
+	}
+}
+
+func handleRequests() {
+	myRouter := newRouter()
+	if _, err := startPprof(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitBindError)
+	}
+	listener, err := listenAgent()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitBindError)
+	}
+	log.Fatal(newServer(myRouter).Serve(listener))
 }
 
 func main() {
-	initializeFromEnv()
+	if err := initializeFromEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfigError)
+	}
+	configureGC()
+	debugLogging.Store(logLevel == "debug")
+	logLevelSignals := make(chan os.Signal, 1)
+	signal.Notify(logLevelSignals, syscall.SIGUSR1)
+	go handleLogLevelSignals(logLevelSignals)
+	if err := openAuditLog(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfigError)
+	}
 
-	// Open http client to dockerSock
-	fd := func(proto, addr string) (conn net.Conn, err error) {
-		return net.Dial("unix", dockerSock)
+	backend := agentBackendConfig()
+	var err error
+	suspendResumeOps, err = SelectSuspendResumeOps(&backend)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfigError)
 	}
-	tr := &http.Transport{
-		Dial: fd,
+	containerRuntime, dockerSock = backend.Runtime, backend.DockerSock
+	fmt.Fprintf(os.Stdout, "Using the %s backend\n", suspendResumeOps.Name())
+	if breakerThreshold > 0 {
+		suspendResumeOps = NewCircuitBreakerOps(suspendResumeOps)
+	}
+	if latencyHistogram {
+		expvar.Publish("opLatency", expvar.Func(opLatencySummary))
+	}
+
+	client, err = newDockerSockHttpClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfigError)
+	}
+	if maxDockerConns > 0 {
+		dockerSem = make(chan struct{}, maxDockerConns)
 	}
-	client = &http.Client{Transport: tr}
 
 	handleRequests()
 }
@@ -0,0 +1,1626 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Restore *p when t finishes, so a test can change package settings freely
+func preserve[T any](t testing.TB, p *T) {
+	saved := *p
+	t.Cleanup(func() { *p = saved })
+}
+
+// Start t from no config file and no DOCKER_HOST
+func freshConfig(t *testing.T) {
+	preserve(t, &fileConfig)
+	preserve(t, &usedFileConfig)
+	fileConfig = make(map[string]string)
+	usedFileConfig = make(map[string]bool)
+	t.Setenv("INVOKER_AGENT_CONFIG_FILE", "")
+	t.Setenv("DOCKER_HOST", "")
+}
+
+// Write content to a config file and point INVOKER_AGENT_CONFIG_FILE at it
+func useConfigFile(t *testing.T, name string, content string) {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("INVOKER_AGENT_CONFIG_FILE", path)
+}
+
+// Serve handler as a stub docker daemon on a unix socket, and point the
+// agent's docker client (and the docker backend) at it
+func stubDocker(t *testing.T, handler http.HandlerFunc) {
+	// Keep the socket path well within the unix socket length limit
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	preserve(t, &dockerSock)
+	preserve(t, &dockerTcpAddress)
+	preserve(t, &client)
+	preserve(t, &dockerSem)
+	preserve(t, &suspendResumeOps)
+	dockerSock, dockerTcpAddress = sock, ""
+	useDockerClient(t)
+	suspendResumeOps = DockerSuspendResumeOps{}
+}
+
+// Rebuild the agent's docker client from the current settings
+func useDockerClient(t *testing.T) {
+	var err error
+	if client, err = newDockerSockHttpClient(); err != nil {
+		t.Fatal(err)
+	}
+	dockerSem = nil
+	if maxDockerConns > 0 {
+		dockerSem = make(chan struct{}, maxDockerConns)
+	}
+}
+
+// Serve req with the agent's router
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+	return w
+}
+
+func TestConfigDefaults(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &invokerAgentPort)
+	preserve(t, &timeOps)
+	t.Setenv("INVOKER_AGENT_PORT", "")
+	t.Setenv("INVOKER_AGENT_TIME_OPS", "")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if invokerAgentPort != 3233 || timeOps {
+		t.Errorf("got port %d, timeOps %v; want the defaults 3233, false", invokerAgentPort, timeOps)
+	}
+}
+
+func TestConfigFileOnly(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &invokerAgentPort)
+	preserve(t, &timeOps)
+	preserve(t, &dockerSock)
+	t.Setenv("INVOKER_AGENT_PORT", "")
+	t.Setenv("INVOKER_AGENT_TIME_OPS", "")
+	t.Setenv("INVOKER_AGENT_DOCKER_SOCK", "")
+	useConfigFile(t, "agent.yaml", "port: 4000\ntime_ops: true\nDOCKER_SOCK: /run/file.sock\n")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if invokerAgentPort != 4000 || !timeOps || dockerSock != "/run/file.sock" {
+		t.Errorf("got port %d, timeOps %v, dockerSock %s; want the file's values", invokerAgentPort, timeOps, dockerSock)
+	}
+}
+
+func TestConfigJsonFile(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &invokerAgentPort)
+	t.Setenv("INVOKER_AGENT_PORT", "")
+	useConfigFile(t, "agent.json", `{"port": 4001}`)
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if invokerAgentPort != 4001 {
+		t.Errorf("got port %d; want 4001", invokerAgentPort)
+	}
+}
+
+func TestConfigEnvOverridesFile(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &invokerAgentPort)
+	preserve(t, &timeOps)
+	t.Setenv("INVOKER_AGENT_PORT", "5000")
+	t.Setenv("INVOKER_AGENT_TIME_OPS", "")
+	useConfigFile(t, "agent.yaml", "port: 4000\ntime_ops: true\n")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if invokerAgentPort != 5000 {
+		t.Errorf("got port %d; want the environment's 5000", invokerAgentPort)
+	}
+	if !timeOps {
+		t.Error("time_ops from the file was not applied")
+	}
+}
+
+func TestConfigDockerHostOverridesFile(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &dockerSock)
+	t.Setenv("INVOKER_AGENT_DOCKER_SOCK", "")
+	useConfigFile(t, "agent.yaml", "docker_sock: /run/file.sock\n")
+	t.Setenv("DOCKER_HOST", "unix:///run/env.sock")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if dockerSock != "/run/env.sock" {
+		t.Errorf("got dockerSock %s; want DOCKER_HOST's /run/env.sock", dockerSock)
+	}
+}
+
+func TestConfigUnknownKey(t *testing.T) {
+	freshConfig(t)
+	useConfigFile(t, "agent.yaml", "no_such_setting: 1\n")
+	if err := initializeFromEnv(); err == nil {
+		t.Error("want an error for an unknown config file key")
+	}
+}
+
+func TestConfigInvalidFile(t *testing.T) {
+	freshConfig(t)
+	useConfigFile(t, "agent.yaml", "port: [\n")
+	if err := initializeFromEnv(); err == nil {
+		t.Error("want an error for a malformed config file")
+	}
+}
+
+// Restore the runtime's GC settings when t finishes
+func preserveGC(t *testing.T) {
+	preserve(t, &gcPercent)
+	preserve(t, &memoryLimit)
+	percent := debug.SetGCPercent(100)
+	debug.SetGCPercent(percent)
+	limit := debug.SetMemoryLimit(-1)
+	t.Cleanup(func() {
+		debug.SetGCPercent(percent)
+		debug.SetMemoryLimit(limit)
+	})
+}
+
+func TestConfigureGCFromConfig(t *testing.T) {
+	freshConfig(t)
+	preserveGC(t)
+	t.Setenv("INVOKER_AGENT_GOGC", "50")
+	t.Setenv("INVOKER_AGENT_MEMORY_LIMIT", "1073741824")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	configureGC()
+	if got := debug.SetGCPercent(100); got != 50 {
+		t.Errorf("GOGC is %d; want 50", got)
+	}
+	if got := debug.SetMemoryLimit(-1); got != 1<<30 {
+		t.Errorf("memory limit is %d; want %d", got, 1<<30)
+	}
+}
+
+func TestConfigureGCKeepsRuntimeSettings(t *testing.T) {
+	freshConfig(t)
+	preserveGC(t)
+	t.Setenv("INVOKER_AGENT_GOGC", "")
+	t.Setenv("INVOKER_AGENT_MEMORY_LIMIT", "")
+	// As if set by the GOGC and GOMEMLIMIT envvars
+	debug.SetGCPercent(77)
+	debug.SetMemoryLimit(1 << 29)
+	configureGC()
+	if got := debug.SetGCPercent(100); got != 77 {
+		t.Errorf("GOGC is %d; want the runtime's 77", got)
+	}
+	if got := debug.SetMemoryLimit(-1); got != 1<<29 {
+		t.Errorf("memory limit is %d; want the runtime's %d", got, 1<<29)
+	}
+	if gcPercent != 77 || memoryLimit != 1<<29 {
+		t.Errorf("reported gogc %d, memory_limit %d; want the runtime's settings", gcPercent, memoryLimit)
+	}
+}
+
+func TestDockerConcurrencyLimit(t *testing.T) {
+	preserve(t, &maxDockerConns)
+	maxDockerConns = 1
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+
+	// An unclosed response holds the only connection, and so the only slot
+	held, err := dockerRequest(context.Background(), "GET", "/_ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rejected := dockerRequestsRejected.Value()
+	if _, err := dockerRequest(ctx, "GET", "/_ping"); err != errDockerBusy {
+		t.Fatalf("got error %v; want errDockerBusy", err)
+	}
+	if dockerRequestsRejected.Value() != rejected+1 {
+		t.Error("dockerRequestsRejected was not incremented")
+	}
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 503 {
+		t.Errorf("suspend while saturated returned %d; want 503", w.Code)
+	}
+
+	drainAndClose(held)
+	resp, err := dockerRequest(ctx, "GET", "/_ping")
+	if err != nil {
+		t.Fatalf("request after the slot was freed failed: %v", err)
+	}
+	drainAndClose(resp)
+}
+
+// Stub docker daemon knowing one container, wsk0, in state status.
+// Like docker, it refuses to pause or unpause a container that is not running or paused.
+func stubDockerContainer(t *testing.T, status string) {
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /containers/wsk0/json":
+			fmt.Fprintf(w, `{"Name":"/wsk0","State":{"Status":%q}}`, status)
+		case "POST /containers/wsk0/pause", "POST /containers/wsk0/unpause":
+			if status != "running" && status != "paused" {
+				w.WriteHeader(409)
+				fmt.Fprintf(w, `{"message":"Container wsk0 is not running"}`)
+				return
+			}
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprintf(w, `{"message":"No such container"}`)
+		}
+	})
+}
+
+func TestResumeExitedContainer(t *testing.T) {
+	for _, ops := range []SuspendResumeOps{DockerSuspendResumeOps{}, PodmanSuspendResumeOps{}} {
+		for _, conns := range []int{0, 1} {
+			t.Run(fmt.Sprintf("%s/maxDockerConns=%d", ops.Name(), conns), func(t *testing.T) {
+				preserve(t, &maxDockerConns)
+				preserve(t, &dockerTimeout)
+				maxDockerConns, dockerTimeout = conns, 2*time.Second
+				stubDockerContainer(t, "exited")
+				suspendResumeOps = ops
+
+				start := time.Now()
+				w := serve(httptest.NewRequest("POST", "/resume/wsk0", nil))
+				if w.Code != 410 {
+					t.Errorf("got %d %s; want 410", w.Code, w.Body.String())
+				}
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Errorf("took %s; the inspect waited for a connection", elapsed)
+				}
+			})
+		}
+	}
+}
+
+func TestResumeConflictNotExited(t *testing.T) {
+	stubDockerContainer(t, "restarting")
+	if w := serve(httptest.NewRequest("POST", "/resume/wsk0", nil)); w.Code != 409 {
+		t.Errorf("got %d; want docker's 409 for a conflict", w.Code)
+	}
+}
+
+func TestExitedContainerStatusConfigurable(t *testing.T) {
+	preserve(t, &exitedContainerStatus)
+	exitedContainerStatus = 404
+	stubDockerContainer(t, "dead")
+	if w := serve(httptest.NewRequest("POST", "/resume/wsk0", nil)); w.Code != 404 {
+		t.Errorf("got %d; want the configured 404", w.Code)
+	}
+}
+
+func TestPprofDisabled(t *testing.T) {
+	preserve(t, &pprofEnabled)
+	pprofEnabled = false
+	if listener, err := startPprof(); listener != nil || err != nil {
+		t.Errorf("got listener %v, error %v; want neither when disabled", listener, err)
+	}
+	if w := serve(httptest.NewRequest("GET", "/debug/pprof/", nil)); w.Code != 404 {
+		t.Errorf("agent router served /debug/pprof/ with %d; want 404", w.Code)
+	}
+}
+
+func TestPprofEnabled(t *testing.T) {
+	preserve(t, &pprofEnabled)
+	preserve(t, &pprofPort)
+	pprofEnabled, pprofPort = true, 0
+	listener, err := startPprof()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if host, _, _ := net.SplitHostPort(listener.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("pprof listens on %s; want loopback by default", host)
+	}
+	resp, err := http.Get("http://" + listener.Addr().String() + "/debug/pprof/cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("/debug/pprof/cmdline returned %d; want 200", resp.StatusCode)
+	}
+	// Profiles stay off the agent's own port even when enabled
+	if w := serve(httptest.NewRequest("GET", "/debug/pprof/", nil)); w.Code != 404 {
+		t.Errorf("agent router served /debug/pprof/ with %d; want 404", w.Code)
+	}
+}
+
+func TestContainerAllowPattern(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &containerAllowPattern)
+	t.Setenv("INVOKER_AGENT_CONTAINER_ALLOW_PATTERN", "wsk[0-9]+")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	stubDockerContainer(t, "running")
+	for container, want := range map[string]int{
+		"wsk0":    204,
+		"other":   403,
+		"notwsk0": 403, // the pattern matches whole names only
+		"wsk0x":   403,
+	} {
+		if w := serve(httptest.NewRequest("POST", "/suspend/"+container, nil)); w.Code != want {
+			t.Errorf("suspend %s returned %d; want %d", container, w.Code, want)
+		}
+	}
+	body := strings.NewReader(`{"op":"resume","container":"other"}`)
+	if w := serve(httptest.NewRequest("POST", "/op", body)); w.Code != 403 {
+		t.Errorf("/op resume of a disallowed container returned %d; want 403", w.Code)
+	}
+}
+
+func TestContainerAllowPatternDefaultAllowsAll(t *testing.T) {
+	preserve(t, &containerAllowPattern)
+	containerAllowPattern = nil
+	stubDockerContainer(t, "running")
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 204 {
+		t.Errorf("got %d; want 204 with no allow pattern", w.Code)
+	}
+}
+
+// Audit container operations to a fresh file, returning a function reading its entries
+func useAuditLog(t *testing.T) func() []auditEntry {
+	preserve(t, &auditFile)
+	auditFile = filepath.Join(t.TempDir(), "audit.log")
+	if err := openAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auditLog.Lock()
+		defer auditLog.Unlock()
+		auditLog.file.Close()
+		auditLog.file = nil
+	})
+	return func() []auditEntry {
+		data, err := os.ReadFile(auditFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []auditEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid audit line %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	readAudit := useAuditLog(t)
+	stubDockerContainer(t, "running")
+
+	req := httptest.NewRequest("POST", "/suspend/wsk0", nil)
+	req.Header.Set("X-Activation-Id", "act1")
+	serve(req)
+	serve(httptest.NewRequest("POST", "/op", strings.NewReader(`{"op":"resume","container":"wsk0"}`)))
+	serve(httptest.NewRequest("POST", "/resume/wsk1", nil))
+
+	entries := readAudit()
+	if len(entries) != 3 {
+		t.Fatalf("got %d audit entries; want 3", len(entries))
+	}
+	want := []struct {
+		container, op, outcome string
+		status                 int
+	}{
+		{"wsk0", "pause", "success", 204},
+		{"wsk0", "unpause", "success", 200},
+		{"wsk1", "unpause", "failure", 404},
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Container != w.container || e.Operation != w.op || e.Outcome != w.outcome || e.Status != w.status {
+			t.Errorf("entry %d is %+v; want %+v", i, e, w)
+		}
+		if e.Backend != "docker" || e.Caller != "192.0.2.1" || e.Time == "" {
+			t.Errorf("entry %d is %+v; want backend, caller and time filled in", i, e)
+		}
+	}
+	if entries[0].ActivationId != "act1" {
+		t.Errorf("got activation id %q; want act1", entries[0].ActivationId)
+	}
+	if entries[2].Error == "" {
+		t.Error("failed operation was audited without its error")
+	}
+}
+
+func TestAuditLogAsync(t *testing.T) {
+	preserve(t, &asyncOps)
+	asyncOps = true
+	readAudit := useAuditLog(t)
+	stubDockerContainer(t, "exited")
+
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 202 {
+		t.Fatalf("got %d; want 202", w.Code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(readAudit()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	entries := readAudit()
+	if len(entries) != 1 || entries[0].Status != 202 || entries[0].Outcome != "failure" {
+		t.Errorf("got %+v; want one failure audited with the 202 the caller was sent", entries)
+	}
+}
+
+// Use ops as the backend for the duration of the test
+func useOps(t testing.TB, ops SuspendResumeOps) {
+	preserve(t, &suspendResumeOps)
+	suspendResumeOps = ops
+}
+
+func TestPercentileMillis(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	for _, test := range []struct {
+		p    float64
+		want float64
+	}{{0, 1}, {1, 1}, {50, 50}, {99, 99}, {100, 100}} {
+		if got := percentileMillis(sorted, test.p); got != test.want {
+			t.Errorf("p%v: got %v; want %v", test.p, got, test.want)
+		}
+	}
+	if got := percentileMillis([]time.Duration{3 * time.Millisecond}, 99); got != 3 {
+		t.Errorf("single sample: got %v; want 3", got)
+	}
+}
+
+func TestRecordOpLatencyWraparound(t *testing.T) {
+	t.Cleanup(func() {
+		opLatencies.Lock()
+		delete(opLatencies.m, "test")
+		opLatencies.Unlock()
+	})
+	for i := 0; i < latencySamples; i++ {
+		recordOpLatency("test", time.Now().Add(-time.Hour))
+	}
+	for i := 0; i < 10; i++ {
+		recordOpLatency("test", time.Now())
+	}
+
+	opLatencies.Lock()
+	defer opLatencies.Unlock()
+	ring := opLatencies.m["test"]
+	if len(ring.samples) != latencySamples || ring.count != latencySamples+10 || ring.next != 10 {
+		t.Fatalf("got %d samples, count %d, next %d; want %d, %d, 10", len(ring.samples), ring.count, ring.next, latencySamples, latencySamples+10)
+	}
+	// The 10 newest overwrote the oldest
+	for i, d := range ring.samples {
+		if old := d >= time.Hour; old != (i >= 10) {
+			t.Fatalf("sample %d is %v", i, d)
+		}
+	}
+}
+
+func benchmarkHandler(b *testing.B, newRequest func() *http.Request) {
+	useOps(b, stubOps{func(string) error { return nil }})
+	router := newRouter()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, newRequest())
+		if resp.Code >= 300 {
+			b.Fatalf("got %d: %s", resp.Code, resp.Body)
+		}
+	}
+}
+
+func BenchmarkSuspend(b *testing.B) {
+	benchmarkHandler(b, func() *http.Request { return httptest.NewRequest("POST", "/suspend/wsk0", nil) })
+}
+
+func BenchmarkSuspendWithLatencyHistogram(b *testing.B) {
+	preserve(b, &latencyHistogram)
+	latencyHistogram = true
+	benchmarkHandler(b, func() *http.Request { return httptest.NewRequest("POST", "/suspend/wsk0", nil) })
+}
+
+func BenchmarkOpRequest(b *testing.B) {
+	benchmarkHandler(b, func() *http.Request {
+		return httptest.NewRequest("POST", "/op", strings.NewReader(`{"op":"resume","container":"wsk0"}`))
+	})
+}
+
+// Run f, returning what it wrote to stdout
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	defer func() {
+		os.Stdout = saved
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestActivationId(t *testing.T) {
+	stubDockerContainer(t, "running")
+	for _, test := range []struct {
+		header, value string
+	}{{"X-Activation-Id", "act1"}, {"X-Request-Id", "req1"}} {
+		req := httptest.NewRequest("POST", "/suspend/wsk0", nil)
+		req.Header.Set(test.header, test.value)
+		if got := serve(req).Header().Get("X-Activation-Id"); got != test.value {
+			t.Errorf("with %s, echoed %q; want %q", test.header, got, test.value)
+		}
+	}
+	first := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)).Header().Get("X-Activation-Id")
+	second := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)).Header().Get("X-Activation-Id")
+	if len(first) != 32 || first == second {
+		t.Errorf("generated ids %q and %q; want distinct random ones", first, second)
+	}
+}
+
+func TestActivationIdLogged(t *testing.T) {
+	stubDockerContainer(t, "running")
+	out := captureStdout(t, func() {
+		req := httptest.NewRequest("POST", "/resume/wsk1", nil)
+		req.Header.Set("X-Activation-Id", "act1")
+		serve(req)
+	})
+	if !strings.Contains(out, "[activationId=act1] Unpausing wsk1 failed") {
+		t.Errorf("logged %q; want the failure tagged with the activation id", out)
+	}
+}
+
+func TestFailureLogNamesBackend(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		preserve(t, &asyncOps)
+		asyncOps = async
+		stubDockerContainer(t, "running")
+		suspendResumeOps = PodmanSuspendResumeOps{}
+		out := captureStdout(t, func() {
+			w := serve(httptest.NewRequest("POST", "/resume/wsk1", nil))
+			if async {
+				var started struct{ Id string }
+				json.NewDecoder(w.Body).Decode(&started)
+				awaitOperation(t, started.Id, opFailed)
+			}
+		})
+		// Logged at the default level, not only with debug logging
+		if !strings.Contains(out, "Unpausing wsk1 failed: no such container (using the podman backend)") {
+			t.Errorf("async %v: logged %q; want the failure with its backend", async, out)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	preserve(t, &requestTimeout)
+	requestTimeout = 50 * time.Millisecond
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		// A daemon that hangs until the agent gives up
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(204)
+	})
+	start := time.Now()
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 504 {
+		t.Errorf("got %d %s; want 504", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s; want the request cut off after %s", elapsed, requestTimeout)
+	}
+}
+
+func TestReadyWithoutDocker(t *testing.T) {
+	preserve(t, &dockerSock)
+	preserve(t, &dockerTcpAddress)
+	preserve(t, &client)
+	preserve(t, &dockerSem)
+	dockerSock, dockerTcpAddress = filepath.Join(t.TempDir(), "missing.sock"), ""
+	useDockerClient(t)
+	if w := serve(httptest.NewRequest("GET", "/ready", nil)); w.Code != 503 {
+		t.Errorf("got %d; want 503 with no docker daemon", w.Code)
+	}
+}
+
+func TestReady(t *testing.T) {
+	pingStatus := 200
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_ping" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(pingStatus)
+		fmt.Fprint(w, "OK")
+	})
+	if w := serve(httptest.NewRequest("GET", "/ready", nil)); w.Code != 200 {
+		t.Errorf("got %d; want 200 with a healthy daemon", w.Code)
+	}
+	pingStatus = 500
+	if w := serve(httptest.NewRequest("GET", "/ready", nil)); w.Code != 503 {
+		t.Errorf("got %d; want 503 when the ping fails", w.Code)
+	}
+}
+
+// Run the agent's main in a child process with the given extra environment,
+// returning its exit code
+func runMain(t *testing.T, env ...string) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExitCodes$")
+	cmd.Env = append(os.Environ(), append([]string{"INVOKER_AGENT_TEST_RUN_MAIN=1"}, env...)...)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestExitCodes(t *testing.T) {
+	if os.Getenv("INVOKER_AGENT_TEST_RUN_MAIN") == "1" {
+		main()
+		return
+	}
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, port, _ := net.SplitHostPort(busy.Addr().String())
+
+	if code := runMain(t, "INVOKER_AGENT_PORT=bogus"); code != exitConfigError {
+		t.Errorf("invalid port exited with %d; want %d", code, exitConfigError)
+	}
+	if code := runMain(t, "INVOKER_AGENT_RUNTIME=podman", "INVOKER_AGENT_DOCKER_SOCK="+filepath.Join(t.TempDir(), "missing.sock")); code != exitConfigError {
+		t.Errorf("unavailable runtime exited with %d; want %d", code, exitConfigError)
+	}
+	if code := runMain(t, "INVOKER_AGENT_BIND_ADDRESS=127.0.0.1", "INVOKER_AGENT_PORT="+port, "INVOKER_AGENT_DOCKER_TCP_ADDRESS=127.0.0.1:1"); code != exitBindError {
+		t.Errorf("port in use exited with %d; want %d", code, exitBindError)
+	}
+}
+
+// The current state of operation id, as reported by /operations/<id>
+func fetchOperation(t *testing.T, id string) operation {
+	w := serve(httptest.NewRequest("GET", "/operations/"+id, nil))
+	if w.Code != 200 {
+		t.Fatalf("/operations/%s returned %d", id, w.Code)
+	}
+	var o operation
+	if err := json.NewDecoder(w.Body).Decode(&o); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// Poll /operations/<id> until the operation reaches one of statuses
+func awaitOperation(t *testing.T, id string, statuses ...string) operation {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		o := fetchOperation(t, id)
+		for _, status := range statuses {
+			if o.Status == status {
+				return o
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("operation %s is %s; want one of %v", id, o.Status, statuses)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAsyncOperations(t *testing.T) {
+	preserve(t, &asyncOps)
+	asyncOps = true
+	// Pauses of wsk0 block until released, so the operation can be seen in progress
+	pausing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /containers/wsk0/pause":
+			pausing <- struct{}{}
+			<-release
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"message":"No such container"}`)
+		}
+	})
+
+	w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil))
+	var started struct{ Id string }
+	if err := json.NewDecoder(w.Body).Decode(&started); err != nil || w.Code != 202 {
+		close(release)
+		t.Fatalf("got %d, %v; want 202 and an operation id", w.Code, err)
+	}
+	if loc := w.Header().Get("Location"); loc != "/operations/"+started.Id {
+		t.Errorf("Location is %q; want /operations/%s", loc, started.Id)
+	}
+	// Until the background operation starts it is accepted
+	if o := fetchOperation(t, started.Id); o.Status != opAccepted && o.Status != opInProgress {
+		t.Errorf("just started, operation is %s; want %s or %s", o.Status, opAccepted, opInProgress)
+	}
+	<-pausing
+	if o := fetchOperation(t, started.Id); o.Status != opInProgress {
+		t.Errorf("while docker pauses, operation is %s; want %s", o.Status, opInProgress)
+	}
+	close(release)
+	if o := awaitOperation(t, started.Id, opDone, opFailed); o.Status != opDone || o.Op != "pause" || o.Container != "wsk0" {
+		t.Errorf("got %+v; want a finished pause of wsk0", o)
+	}
+
+	w = serve(httptest.NewRequest("POST", "/op", strings.NewReader(`{"op":"resume","container":"wsk1"}`)))
+	var result opResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || w.Code != 202 || result.OperationId == "" {
+		t.Fatalf("got %d %+v, %v; want 202 and an operation id", w.Code, result, err)
+	}
+	if o := awaitOperation(t, result.OperationId, opDone, opFailed); o.Status != opFailed || o.Error == "" {
+		t.Errorf("got %+v; want a failure with its error", o)
+	}
+
+	if w := serve(httptest.NewRequest("GET", "/operations/nosuchid", nil)); w.Code != 404 {
+		t.Errorf("unknown operation returned %d; want 404", w.Code)
+	}
+}
+
+func TestAsyncOperationsExpire(t *testing.T) {
+	preserve(t, &asyncOps)
+	preserve(t, &operationTTL)
+	asyncOps, operationTTL = true, time.Millisecond
+	stubDockerContainer(t, "running")
+
+	w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil))
+	var started struct{ Id string }
+	json.NewDecoder(w.Body).Decode(&started)
+	// The operation is forgotten once it has finished and its TTL has passed
+	deadline := time.Now().Add(2 * time.Second)
+	for serve(httptest.NewRequest("GET", "/operations/"+started.Id, nil)).Code != 404 {
+		if time.Now().After(deadline) {
+			t.Fatal("finished operation never expired")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBindAddressConfig(t *testing.T) {
+	for value, want := range map[string]string{"127.0.0.1": "127.0.0.1", "::1": "::1", "[::1]": "::1"} {
+		freshConfig(t)
+		preserve(t, &bindAddress)
+		t.Setenv("INVOKER_AGENT_BIND_ADDRESS", value)
+		if err := initializeFromEnv(); err != nil {
+			t.Fatal(err)
+		}
+		if bindAddress != want {
+			t.Errorf("%s was read as %s; want %s", value, bindAddress, want)
+		}
+	}
+}
+
+func TestListenAgent(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "::1"} {
+		preserve(t, &bindAddress)
+		preserve(t, &invokerAgentPort)
+		bindAddress, invokerAgentPort = address, 0
+		listener, err := listenAgent()
+		if err != nil {
+			if address == "::1" {
+				t.Logf("skipping IPv6: %v", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		host, _, _ := net.SplitHostPort(listener.Addr().String())
+		listener.Close()
+		if host != address {
+			t.Errorf("listening on %s; want %s", host, address)
+		}
+	}
+}
+
+func TestDockerRateLimited(t *testing.T) {
+	preserve(t, &dockerRetryAfter)
+	dockerRetryAfter = 2500 * time.Millisecond
+	message := `{"message":"toomanyrequests: Too Many Requests"}`
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		fmt.Fprint(w, message)
+	})
+
+	limited := dockerRequestsRateLimited.Value()
+	w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil))
+	if w.Code != 429 || w.Header().Get("Retry-After") != "3" {
+		t.Errorf("got %d with Retry-After %q; want 429 with 3", w.Code, w.Header().Get("Retry-After"))
+	}
+	if dockerRequestsRateLimited.Value() != limited+1 {
+		t.Error("dockerRequestsRateLimited was not incremented")
+	}
+
+	message = `{"message":"driver failed"}`
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 500 || w.Header().Get("Retry-After") != "" {
+		t.Errorf("got %d with Retry-After %q; want a plain 500 for other errors", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestIsOpenWhiskContainer(t *testing.T) {
+	preserve(t, &openwhiskNamePrefix)
+	preserve(t, &openwhiskLabel)
+	openwhiskNamePrefix, openwhiskLabel = "wsk", "openwhisk.action"
+	for _, test := range []struct {
+		name   string
+		labels map[string]string
+		want   bool
+	}{
+		{"/wsk0_123_guest_hello", nil, true},
+		{"/k8s_user-action_x", map[string]string{"io.kubernetes.pod.name": "wskinvoker-00-1-guest-hello"}, true},
+		{"/other", map[string]string{"openwhisk.action": ""}, true},
+		{"/other", nil, false},
+		{"/other", map[string]string{"io.kubernetes.pod.name": "nginx"}, false},
+	} {
+		info := &containerInfo{Name: test.name}
+		info.Config.Labels = test.labels
+		if got := isOpenWhiskContainer(info); got != test.want {
+			t.Errorf("%s with labels %v: got %v; want %v", test.name, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestVerifyOpenWhiskContainers(t *testing.T) {
+	preserve(t, &verifyOpenWhiskContainers)
+	verifyOpenWhiskContainers = true
+	var mu sync.Mutex
+	paused := map[string]bool{}
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/") // "", "containers", name, op
+		if len(parts) != 4 {
+			w.WriteHeader(404)
+			return
+		}
+		if parts[3] == "json" {
+			fmt.Fprintf(w, `{"Name":"/%s","State":{"Status":"running"}}`, parts[2])
+			return
+		}
+		mu.Lock()
+		paused[parts[2]] = true
+		mu.Unlock()
+		w.WriteHeader(204)
+	})
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 204 {
+		t.Errorf("suspend of an OpenWhisk container returned %d; want 204", w.Code)
+	}
+	if w := serve(httptest.NewRequest("POST", "/suspend/nginx", nil)); w.Code != 403 {
+		t.Errorf("suspend of another container returned %d; want 403", w.Code)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if paused["nginx"] || !paused["wsk0"] {
+		t.Errorf("paused %v; want only wsk0", paused)
+	}
+}
+
+func TestDockerDialTimeoutConfig(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &dockerDialTimeout)
+	t.Setenv("INVOKER_AGENT_DOCKER_DIAL_TIMEOUT", "250ms")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if dockerDialTimeout != 250*time.Millisecond {
+		t.Errorf("got %s; want 250ms", dockerDialTimeout)
+	}
+	t.Setenv("INVOKER_AGENT_DOCKER_DIAL_TIMEOUT", "soon")
+	if err := initializeFromEnv(); err == nil {
+		t.Error("want an error for an invalid duration")
+	}
+}
+
+func TestDockerUnresponsive(t *testing.T) {
+	// A socket that accepts connections but never answers on them
+	dir, err := os.MkdirTemp("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	listener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+
+	preserve(t, &dockerSock)
+	preserve(t, &dockerTcpAddress)
+	preserve(t, &client)
+	preserve(t, &dockerSem)
+	preserve(t, &dockerDialTimeout)
+	preserve(t, &dockerTimeout)
+	useOps(t, DockerSuspendResumeOps{})
+	dockerSock, dockerTcpAddress = listener.Addr().String(), ""
+	dockerDialTimeout, dockerTimeout = 50*time.Millisecond, 100*time.Millisecond
+	useDockerClient(t)
+
+	start := time.Now()
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 504 {
+		t.Errorf("got %d %s; want 504", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s; want the request abandoned after %s", elapsed, dockerTimeout)
+	}
+}
+
+func TestErrorFormats(t *testing.T) {
+	stubDockerContainer(t, "running")
+	for _, format := range []string{"plain", "json", "problem"} {
+		preserve(t, &errorFormat)
+		errorFormat = format
+		w := serve(httptest.NewRequest("POST", "/suspend/wsk1", nil))
+		if w.Code != 404 {
+			t.Fatalf("%s: got %d; want 404", format, w.Code)
+		}
+		body := w.Body.String()
+		switch format {
+		case "plain":
+			if !strings.HasPrefix(body, "Pausing wsk1 failed") {
+				t.Errorf("plain: got body %q", body)
+			}
+		case "json":
+			var got map[string]string
+			if err := json.Unmarshal([]byte(body), &got); err != nil || w.Header().Get("Content-Type") != "application/json" || !strings.HasPrefix(got["error"], "Pausing wsk1 failed") {
+				t.Errorf("json: got %s %q, %v", w.Header().Get("Content-Type"), body, err)
+			}
+		case "problem":
+			var got problemDetails
+			if err := json.Unmarshal([]byte(body), &got); err != nil || w.Header().Get("Content-Type") != "application/problem+json" {
+				t.Fatalf("problem: got %s %q, %v", w.Header().Get("Content-Type"), body, err)
+			}
+			if got.Type != "about:blank" || got.Title != "Not Found" || got.Status != 404 || !strings.HasPrefix(got.Detail, "Pausing wsk1 failed") {
+				t.Errorf("problem: got %+v", got)
+			}
+		}
+	}
+}
+
+// Rate limit each container to rate operations per second, bursting to burst
+func useContainerOpRate(t *testing.T, rate float64, burst int) {
+	preserve(t, &containerOpRate)
+	preserve(t, &containerOpBurst)
+	containerOpRate, containerOpBurst = rate, burst
+	containerBuckets.Lock()
+	saved := containerBuckets.m
+	containerBuckets.m = make(map[string]*tokenBucket)
+	containerBuckets.Unlock()
+	t.Cleanup(func() {
+		containerBuckets.Lock()
+		containerBuckets.m = saved
+		containerBuckets.Unlock()
+	})
+}
+
+func TestTakeContainerToken(t *testing.T) {
+	useContainerOpRate(t, 2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if wait := takeContainerToken("wsk0", now); wait != 0 {
+			t.Fatalf("operation %d within the burst must wait %s", i, wait)
+		}
+	}
+	if wait := takeContainerToken("wsk0", now); wait != 500*time.Millisecond {
+		t.Errorf("got wait %s; want 500ms at 2/s", wait)
+	}
+	// Each container has its own bucket
+	if wait := takeContainerToken("wsk1", now); wait != 0 {
+		t.Errorf("another container must wait %s", wait)
+	}
+	if wait := takeContainerToken("wsk0", now.Add(500*time.Millisecond)); wait != 0 {
+		t.Errorf("after refilling, got wait %s", wait)
+	}
+}
+
+func TestTakeContainerTokenUnlimited(t *testing.T) {
+	useContainerOpRate(t, 0, 1)
+	for i := 0; i < 100; i++ {
+		if wait := takeContainerToken("wsk0", time.Now()); wait != 0 {
+			t.Fatalf("operation %d must wait %s with rate limiting disabled", i, wait)
+		}
+	}
+}
+
+func TestContainerOpRateLimited(t *testing.T) {
+	useContainerOpRate(t, 0.5, 1)
+	stubDockerContainer(t, "running")
+	throttled := containerOpsThrottled.Value()
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 204 {
+		t.Fatalf("first suspend returned %d; want 204", w.Code)
+	}
+	w := serve(httptest.NewRequest("POST", "/resume/wsk0", nil))
+	if w.Code != 429 || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("got %d with Retry-After %q; want 429 with 2", w.Code, w.Header().Get("Retry-After"))
+	}
+	if containerOpsThrottled.Value() != throttled+1 {
+		t.Error("containerOpsThrottled was not incremented")
+	}
+}
+
+func TestListPaused(t *testing.T) {
+	listing := `[{"Id":"abc"},{"Id":"def"}]`
+	var filters string
+	var mu sync.Mutex
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/json" {
+			w.WriteHeader(404)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		filters = r.URL.Query().Get("filters")
+		if listing == "" {
+			w.WriteHeader(500)
+			return
+		}
+		fmt.Fprint(w, listing)
+	})
+
+	w := serve(httptest.NewRequest("GET", "/paused", nil))
+	var ids []string
+	if err := json.NewDecoder(w.Body).Decode(&ids); err != nil || w.Code != 200 {
+		t.Fatalf("got %d, %v", w.Code, err)
+	}
+	if strings.Join(ids, ",") != "abc,def" {
+		t.Errorf("got %v; want [abc def]", ids)
+	}
+	mu.Lock()
+	if filters != `{"status":["paused"]}` {
+		t.Errorf("docker was asked for %s; want only paused containers", filters)
+	}
+	mu.Unlock()
+
+	setListing := func(l string) {
+		mu.Lock()
+		listing = l
+		mu.Unlock()
+	}
+	setListing(`[]`)
+	if w := serve(httptest.NewRequest("GET", "/paused", nil)); strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("got %q; want an empty array", w.Body.String())
+	}
+	setListing("")
+	if w := serve(httptest.NewRequest("GET", "/paused", nil)); w.Code != 500 {
+		t.Errorf("got %d; want 500 when docker fails", w.Code)
+	}
+}
+
+func TestParseDockerHost(t *testing.T) {
+	for _, test := range []struct {
+		host, sock, tcp string
+		ok              bool
+	}{
+		{"unix:///run/docker.sock", "/run/docker.sock", "", true},
+		{"tcp://10.0.0.1:2375", "", "10.0.0.1:2375", true},
+		{"unix://", "", "", false},
+		{"tcp://", "", "", false},
+		{"npipe:////./pipe/docker_engine", "", "", false},
+	} {
+		preserve(t, &dockerSock)
+		preserve(t, &dockerTcpAddress)
+		dockerSock, dockerTcpAddress = "", ""
+		err := parseDockerHost(test.host)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v; want ok %v", test.host, err, test.ok)
+		} else if dockerSock != test.sock || dockerTcpAddress != test.tcp {
+			t.Errorf("%s: got sock %q, tcp %q; want %q, %q", test.host, dockerSock, dockerTcpAddress, test.sock, test.tcp)
+		}
+	}
+}
+
+func TestConfigDockerHost(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &dockerSock)
+	preserve(t, &dockerTcpAddress)
+	t.Setenv("INVOKER_AGENT_DOCKER_SOCK", "")
+	t.Setenv("DOCKER_HOST", "tcp://docker:2375")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if dockerTcpAddress != "docker:2375" {
+		t.Errorf("got tcp address %q; want DOCKER_HOST's docker:2375", dockerTcpAddress)
+	}
+	// The agent's own setting wins over DOCKER_HOST
+	t.Setenv("INVOKER_AGENT_DOCKER_SOCK", "/run/agent.sock")
+	t.Setenv("DOCKER_HOST", "unix:///run/env.sock")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if dockerSock != "/run/agent.sock" {
+		t.Errorf("got sock %q; want INVOKER_AGENT_DOCKER_SOCK's /run/agent.sock", dockerSock)
+	}
+}
+
+// Point the agent's docker client at the stub daemon server over TCP
+func useTcpDocker(t *testing.T, server *httptest.Server) {
+	preserve(t, &dockerSock)
+	preserve(t, &dockerTcpAddress)
+	preserve(t, &client)
+	preserve(t, &dockerSem)
+	useOps(t, DockerSuspendResumeOps{})
+	// The unix socket must not be used when a TCP endpoint is set
+	dockerSock = filepath.Join(t.TempDir(), "missing.sock")
+	dockerTcpAddress = server.Listener.Addr().String()
+	useDockerClient(t)
+}
+
+func dockerPauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/containers/wsk0/pause" {
+		w.WriteHeader(404)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func TestTcpDocker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(dockerPauseHandler))
+	t.Cleanup(server.Close)
+	useTcpDocker(t, server)
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 204 {
+		t.Errorf("got %d %s; want 204", w.Code, w.Body.String())
+	}
+}
+
+func TestTcpDockerTls(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(dockerPauseHandler))
+	t.Cleanup(server.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(ca, pemData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	preserve(t, &dockerTlsCa)
+	dockerTlsCa = ca
+	useTcpDocker(t, server)
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 204 {
+		t.Errorf("got %d %s; want 204", w.Code, w.Body.String())
+	}
+}
+
+func TestConfigDockerTlsRequiresTcp(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &dockerTcpAddress)
+	preserve(t, &dockerTlsCa)
+	dockerTcpAddress = ""
+	t.Setenv("INVOKER_AGENT_DOCKER_TCP_ADDRESS", "")
+	t.Setenv("INVOKER_AGENT_DOCKER_TLS_CA", "/etc/docker/ca.pem")
+	if err := initializeFromEnv(); err == nil {
+		t.Error("want an error for TLS settings without a TCP endpoint")
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	preserve(t, &adminToken)
+	preserve(t, &dockerTlsKey)
+	preserve(t, &invokerAgentPort)
+	adminToken, dockerTlsKey, invokerAgentPort = "s3cret", "/etc/docker/key.pem", 4321
+
+	w := serve(httptest.NewRequest("GET", "/config", nil))
+	if w.Code != 200 || strings.Contains(w.Body.String(), "s3cret") || strings.Contains(w.Body.String(), "key.pem") {
+		t.Fatalf("got %d %s; want secrets redacted", w.Code, w.Body.String())
+	}
+	var config map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	if config["admin_token"] != "<redacted>" || config["docker_tls_key"] != "<redacted>" || config["port"] != 4321.0 {
+		t.Errorf("got admin_token %v, docker_tls_key %v, port %v", config["admin_token"], config["docker_tls_key"], config["port"])
+	}
+
+	// An unset secret is reported as unset
+	adminToken = ""
+	if config := effectiveConfig(); config["admin_token"] != "" {
+		t.Errorf("got admin_token %v; want empty when unset", config["admin_token"])
+	}
+}
+
+func TestLogLevelSignal(t *testing.T) {
+	saved := debugLogging.Load()
+	t.Cleanup(func() { debugLogging.Store(saved) })
+	debugLogging.Store(false)
+
+	// Wait for debug logging to become on
+	await := func(on bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for debugLogging.Load() != on {
+			if time.Now().After(deadline) {
+				t.Fatalf("debug logging never became %v", on)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// The handler runs entirely within the capture, so it only sees the pipe
+	out := captureStdout(t, func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR1)
+		stopped := make(chan struct{})
+		go func() {
+			handleLogLevelSignals(signals)
+			close(stopped)
+		}()
+		defer func() {
+			signal.Stop(signals)
+			close(signals)
+			<-stopped
+		}()
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		await(true)
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		await(false)
+	})
+	if !strings.Contains(out, "debug logging enabled") || !strings.Contains(out, "debug logging disabled") {
+		t.Errorf("logged %q; want both toggles announced", out)
+	}
+}
+
+func TestLogRequestDebug(t *testing.T) {
+	saved := debugLogging.Load()
+	t.Cleanup(func() { debugLogging.Store(saved) })
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, on := range []bool{false, true} {
+		debugLogging.Store(on)
+		out := captureStdout(t, func() { logRequestDebug(req, "detail") })
+		if strings.Contains(out, "detail") != on {
+			t.Errorf("with debug logging %v, logged %q", on, out)
+		}
+	}
+}
+
+func TestOpRequest(t *testing.T) {
+	stubDockerContainer(t, "running")
+	for _, test := range []struct {
+		body   string
+		status int
+	}{
+		{`{"op":"suspend","container":"wsk0"}`, 200},
+		{`{"op":"resume","container":"wsk0"}`, 200},
+		{`{"op":"resume","container":"wsk1"}`, 404},
+		{`{"op":"restart","container":"wsk0"}`, 400},
+		{`{"op":"suspend"}`, 400},
+		{`not json`, 400},
+	} {
+		w := serve(httptest.NewRequest("POST", "/op", strings.NewReader(test.body)))
+		var result opResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: invalid response: %v", test.body, err)
+		}
+		if w.Code != test.status || result.Status != test.status {
+			t.Errorf("%s: got %d with status %d in the body; want %d", test.body, w.Code, result.Status, test.status)
+		}
+		if (result.Error != "") != (test.status != 200) {
+			t.Errorf("%s: got error %q", test.body, result.Error)
+		}
+	}
+	if w := serve(httptest.NewRequest("GET", "/op", nil)); w.Code != 405 {
+		t.Errorf("GET /op returned %d; want 405", w.Code)
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	preserve(t, &serverReadTimeout)
+	serverReadTimeout = 100 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(newRouter())
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	// A client that never finishes sending its headers
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /config HTTP/1.1\r\nHost: agent\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = io.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the server kept the slow connection open")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %s; want about %s", elapsed, serverReadTimeout)
+	}
+}
+
+func TestServerTimeoutsConfig(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &serverReadTimeout)
+	preserve(t, &serverWriteTimeout)
+	preserve(t, &serverIdleTimeout)
+	t.Setenv("INVOKER_AGENT_SERVER_READ_TIMEOUT", "1s")
+	t.Setenv("INVOKER_AGENT_SERVER_WRITE_TIMEOUT", "2s")
+	t.Setenv("INVOKER_AGENT_SERVER_IDLE_TIMEOUT", "3s")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(nil)
+	if server.ReadTimeout != time.Second || server.WriteTimeout != 2*time.Second || server.IdleTimeout != 3*time.Second {
+		t.Errorf("got timeouts %s, %s, %s; want 1s, 2s, 3s", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+}
+
+func TestDockerConnectionReuse(t *testing.T) {
+	// Bodies beyond what net/http drains by itself on Close (256KiB)
+	padding := strings.Repeat(" ", 512<<10)
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/exited0/json":
+			fmt.Fprint(w, `{"Name":"/exited0","State":{"Status":"exited"}}`+padding)
+		case "/containers/exited0/pause":
+			w.WriteHeader(409)
+			fmt.Fprint(w, `{"message":"Container exited0 is not running"}`+padding)
+		case "/containers/limited0/pause":
+			w.WriteHeader(500)
+			fmt.Fprint(w, `{"message":"too many requests"}`+padding)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"message":"No such container"}`+padding)
+		}
+	})
+	var mu sync.Mutex
+	var reused []bool
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			reused = append(reused, info.Reused)
+			mu.Unlock()
+		},
+	})
+	// Each leaves a response body unread by the agent's logic
+	for _, container := range []string{"missing0", "exited0", "limited0", "missing0"} {
+		if err := suspendResumeOps.Suspend(ctx, container); err == nil {
+			t.Fatalf("suspend %s succeeded; want an error", container)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, r := range reused {
+		if i > 0 && !r {
+			t.Errorf("docker request %d of %d opened a new connection", i+1, len(reused))
+		}
+	}
+	if len(reused) != 5 {
+		t.Errorf("saw %d docker requests; want 5", len(reused))
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	preserve(t, &timeOps)
+	preserve(t, &timeOpsStdout)
+	stubDockerContainer(t, "running")
+
+	timeOps = false
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Header().Get("Server-Timing") != "" {
+		t.Errorf("got Server-Timing %q with timeOps off", w.Header().Get("Server-Timing"))
+	}
+
+	timeOps, timeOpsStdout = true, false
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/suspend/wsk0", nil),
+		httptest.NewRequest("POST", "/op", strings.NewReader(`{"op":"resume","container":"wsk0"}`)),
+	} {
+		w := serve(req)
+		timing := w.Header().Get("Server-Timing")
+		matched, _ := regexp.MatchString(`^backend;dur=[0-9.]+, total;dur=[0-9.]+$`, timing)
+		if !matched {
+			t.Errorf("%s: got Server-Timing %q; want backend and total durations", req.URL.Path, timing)
+		}
+	}
+	// Requests not reaching the backend report only the total
+	if timing := serve(httptest.NewRequest("GET", "/config", nil)).Header().Get("Server-Timing"); !strings.HasPrefix(timing, "total;dur=") {
+		t.Errorf("/config: got Server-Timing %q; want only the total", timing)
+	}
+}
+
+func TestAdminKillSwitch(t *testing.T) {
+	preserve(t, &adminToken)
+	adminToken = "s3cret"
+	t.Cleanup(func() { containerOpsDisabled.Store(false) })
+	stubDockerContainer(t, "running")
+	admin := func(route string, token string) int {
+		req := httptest.NewRequest("POST", route, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return serve(req).Code
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		req := httptest.NewRequest("POST", "/admin/disable", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if w := serve(req); w.Code != 401 || w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("token %q: got %d; want 401 with a Bearer challenge", token, w.Code)
+		}
+	}
+	if containerOpsDisabled.Load() {
+		t.Fatal("an unauthorized request disabled suspend/resume")
+	}
+
+	if code := admin("/admin/disable", "s3cret"); code != 204 {
+		t.Fatalf("/admin/disable returned %d; want 204", code)
+	}
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 503 {
+		t.Errorf("suspend while disabled returned %d; want 503", w.Code)
+	}
+	if code := admin("/admin/enable", "s3cret"); code != 204 {
+		t.Fatalf("/admin/enable returned %d; want 204", code)
+	}
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 204 {
+		t.Errorf("suspend after enabling returned %d; want 204", w.Code)
+	}
+}
+
+func TestAdminRoutesNeedToken(t *testing.T) {
+	preserve(t, &adminToken)
+	adminToken = ""
+	if w := serve(httptest.NewRequest("POST", "/admin/disable", nil)); w.Code != 404 {
+		t.Errorf("got %d; want 404 with no admin token configured", w.Code)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, test := range []struct {
+		trusted     bool
+		remote, xff string
+		want        string
+	}{
+		{false, "192.0.2.1:1234", "", "192.0.2.1"},
+		{false, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"}, // untrusted peers cannot claim another address
+		{true, "10.0.0.2:1234", "198.51.100.7", "198.51.100.7"},
+		{true, "10.0.0.2:1234", "198.51.100.7, 10.0.0.3", "198.51.100.7"},    // through two trusted proxies
+		{true, "10.0.0.2:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"}, // a spoofed first hop is ignored
+		{true, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{true, "10.0.0.2:1234", "", "10.0.0.2"},
+	} {
+		preserve(t, &trustedProxies)
+		trustedProxies = nil
+		if test.trusted {
+			trustedProxies = []*net.IPNet{proxies}
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if got := clientAddr(req); got != test.want {
+			t.Errorf("from %s with X-Forwarded-For %q (trusted %v): got %s; want %s", test.remote, test.xff, test.trusted, got, test.want)
+		}
+	}
+}
+
+func TestConfigTrustedProxies(t *testing.T) {
+	freshConfig(t)
+	preserve(t, &trustedProxies)
+	trustedProxies = nil
+	t.Setenv("INVOKER_AGENT_TRUSTED_PROXIES", "10.0.0.0/8, fd00::/8")
+	if err := initializeFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cidrStrings(trustedProxies), ","); got != "10.0.0.0/8,fd00::/8" {
+		t.Errorf("got %s", got)
+	}
+	trustedProxies = nil
+	t.Setenv("INVOKER_AGENT_TRUSTED_PROXIES", "10.0.0.1")
+	if err := initializeFromEnv(); err == nil {
+		t.Error("want an error for an address without a prefix length")
+	}
+}
+
+func TestDockerSockFallback(t *testing.T) {
+	stubDockerContainer(t, "running")
+	preserve(t, &dockerSockFallback)
+	// The primary socket is gone; the stub serves on the fallback
+	dockerSockFallback, dockerSock = dockerSock, filepath.Join(t.TempDir(), "missing.sock")
+	useDockerClient(t)
+
+	fallbacks := dockerFallbackDials.Value()
+	var w *httptest.ResponseRecorder
+	out := captureStdout(t, func() {
+		w = serve(httptest.NewRequest("POST", "/suspend/wsk0", nil))
+	})
+	if w.Code != 204 {
+		t.Errorf("got %d %s; want 204 through the fallback socket", w.Code, w.Body.String())
+	}
+	if dockerFallbackDials.Value() != fallbacks+1 || !strings.Contains(out, "trying "+dockerSockFallback) {
+		t.Errorf("fallback dial was not counted and logged; logged %q", out)
+	}
+
+	// Without a fallback the failure reaches the caller
+	dockerSockFallback = ""
+	useDockerClient(t)
+	if w := serve(httptest.NewRequest("POST", "/suspend/wsk0", nil)); w.Code != 500 {
+		t.Errorf("got %d; want 500 with no socket to reach", w.Code)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/* Default API socket of a runtime */
+type RuntimeSocket struct {
+	Runtime string
+	Sock    string
+}
+
+/* Default API socket of each supported runtime, in autodetection order */
+var runtimeSockets = []RuntimeSocket{
+	{"docker", "/var/run/docker.sock"},
+	{"podman", "/run/podman/podman.sock"},
+}
+
+// Implementation of suspend/resume on top of a container runtime.
+// Failures should be returned as an *opError carrying the HTTP status to report.
+type SuspendResumeOps interface {
+	// Short identifier of the backend for logs, eg "docker"
+	Name() string
+	Suspend(ctx context.Context, container string) error
+	Resume(ctx context.Context, container string) error
+}
+
+// Backend using the Docker Engine API, reached through client
+type DockerSuspendResumeOps struct{}
+
+func (DockerSuspendResumeOps) Name() string {
+	return "docker"
+}
+
+func (DockerSuspendResumeOps) Suspend(ctx context.Context, container string) error {
+	return doContainerOp(ctx, container, "pause", "Pausing")
+}
+
+func (DockerSuspendResumeOps) Resume(ctx context.Context, container string) error {
+	return doContainerOp(ctx, container, "unpause", "Unpausing")
+}
+
+// Backend for podman, whose REST API is compatible with Docker's for
+// pause/unpause; it differs only in the default socket (see runtimeSockets).
+type PodmanSuspendResumeOps struct {
+	DockerSuspendResumeOps
+}
+
+func (PodmanSuspendResumeOps) Name() string {
+	return "podman"
+}
+
+/* The backend in use, selected by containerRuntime */
+var suspendResumeOps SuspendResumeOps
+
+// The backend implementing runtime, or nil if there is none
+func suspendResumeOpsFor(runtime string) SuspendResumeOps {
+	switch runtime {
+	case "docker":
+		return DockerSuspendResumeOps{}
+	case "podman":
+		return PodmanSuspendResumeOps{}
+	case "cgroup":
+		return CgroupFreezerOps{}
+	}
+	return nil
+}
+
+/* Settings choosing the suspend/resume backend */
+type BackendConfig struct {
+	Runtime            string // containerRuntime; empty autodetects
+	DockerSock         string // dockerSock; empty means the runtime's default
+	DockerSockFallback string
+	DockerTcpAddress   string
+	Sockets            []RuntimeSocket                        // default sockets, in autodetection order
+	Stat               func(name string) (os.FileInfo, error) // checks that a socket exists
+}
+
+// The backend configuration given by the agent's settings
+func agentBackendConfig() BackendConfig {
+	return BackendConfig{
+		Runtime:            containerRuntime,
+		DockerSock:         dockerSock,
+		DockerSockFallback: dockerSockFallback,
+		DockerTcpAddress:   dockerTcpAddress,
+		Sockets:            runtimeSockets,
+		Stat:               os.Stat,
+	}
+}
+
+// The default socket of runtime, or "" if it has none
+func (cfg *BackendConfig) defaultSock(runtime string) string {
+	for _, rs := range cfg.Sockets {
+		if rs.Runtime == runtime {
+			return rs.Sock
+		}
+	}
+	return ""
+}
+
+// Choose the suspend/resume backend.
+// An explicit Runtime must be usable: defaulting DockerSock to its socket,
+// that socket (or DockerSockFallback) has to exist. Otherwise the runtime is
+// autodetected by which default socket exists, in the order of Sockets.
+// A configured endpoint (DockerSock or DockerTcpAddress) is assumed to be
+// docker compatible.
+// The cgroup runtime needs to be able to resolve container cgroups; it
+// still uses docker's socket by default for inspecting and listing containers.
+// Sets cfg's Runtime and DockerSock to the selection.
+func SelectSuspendResumeOps(cfg *BackendConfig) (SuspendResumeOps, error) {
+	if cfg.Runtime == "cgroup" {
+		if err := validateCgroupResolver(); err != nil {
+			return nil, err
+		}
+		if cfg.DockerSock == "" && cfg.DockerTcpAddress == "" {
+			cfg.DockerSock = cfg.defaultSock("docker")
+		}
+		return suspendResumeOpsFor(cfg.Runtime), nil
+	}
+	if cfg.Runtime == "" && (cfg.DockerSock != "" || cfg.DockerTcpAddress != "") {
+		cfg.Runtime = "docker"
+	}
+	if cfg.Runtime != "" {
+		ops := suspendResumeOpsFor(cfg.Runtime)
+		if ops == nil {
+			return nil, fmt.Errorf("Runtime %s is not supported", cfg.Runtime)
+		}
+		if cfg.DockerTcpAddress == "" {
+			if cfg.DockerSock == "" {
+				cfg.DockerSock = cfg.defaultSock(cfg.Runtime)
+			}
+			if _, err := cfg.Stat(cfg.DockerSock); err != nil {
+				if _, ferr := cfg.Stat(cfg.DockerSockFallback); cfg.DockerSockFallback == "" || ferr != nil {
+					return nil, fmt.Errorf("Runtime %s is unavailable: %v", cfg.Runtime, err)
+				}
+			}
+		}
+		return ops, nil
+	}
+	for _, rs := range cfg.Sockets {
+		if _, err := cfg.Stat(rs.Sock); err == nil {
+			cfg.Runtime = rs.Runtime
+			cfg.DockerSock = rs.Sock
+			return suspendResumeOpsFor(cfg.Runtime), nil
+		}
+	}
+	return nil, errors.New("No container runtime found; set INVOKER_AGENT_RUNTIME or INVOKER_AGENT_DOCKER_SOCK")
+}
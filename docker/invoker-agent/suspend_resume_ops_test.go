@@ -0,0 +1,173 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A stat function for which exactly the given paths exist
+func statExisting(paths ...string) func(string) (os.FileInfo, error) {
+	return func(name string) (os.FileInfo, error) {
+		for _, p := range paths {
+			if name == p {
+				return nil, nil
+			}
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
+var testSockets = []RuntimeSocket{
+	{"docker", "/test/docker.sock"},
+	{"podman", "/test/podman.sock"},
+}
+
+func TestSelectExplicitRuntime(t *testing.T) {
+	for _, runtime := range []string{"docker", "podman"} {
+		cfg := BackendConfig{Runtime: runtime, Sockets: testSockets, Stat: statExisting("/test/docker.sock", "/test/podman.sock")}
+		ops, err := SelectSuspendResumeOps(&cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", runtime, err)
+		}
+		if ops.Name() != runtime || cfg.Runtime != runtime || cfg.DockerSock != "/test/"+runtime+".sock" {
+			t.Errorf("%s: selected %s on %s", runtime, ops.Name(), cfg.DockerSock)
+		}
+	}
+}
+
+func TestSelectExplicitRuntimeUnavailable(t *testing.T) {
+	// Even though docker is available, an explicit podman must not fall back to it
+	cfg := BackendConfig{Runtime: "podman", Sockets: testSockets, Stat: statExisting("/test/docker.sock")}
+	if ops, err := SelectSuspendResumeOps(&cfg); err == nil {
+		t.Errorf("selected %s; want an error", ops.Name())
+	}
+}
+
+func TestSelectUnsupportedRuntime(t *testing.T) {
+	// This tree has no runc backend
+	cfg := BackendConfig{Runtime: "runc", Sockets: testSockets, Stat: statExisting("/test/docker.sock")}
+	if ops, err := SelectSuspendResumeOps(&cfg); err == nil {
+		t.Errorf("selected %s; want an error", ops.Name())
+	}
+}
+
+func TestSelectAutodetect(t *testing.T) {
+	for _, test := range []struct {
+		existing []string
+		want     string
+	}{
+		{[]string{"/test/docker.sock", "/test/podman.sock"}, "docker"},
+		{[]string{"/test/podman.sock"}, "podman"},
+	} {
+		cfg := BackendConfig{Sockets: testSockets, Stat: statExisting(test.existing...)}
+		ops, err := SelectSuspendResumeOps(&cfg)
+		if err != nil {
+			t.Fatalf("with %v: %v", test.existing, err)
+		}
+		if ops.Name() != test.want || cfg.Runtime != test.want || cfg.DockerSock != "/test/"+test.want+".sock" {
+			t.Errorf("with %v: selected %s on %s; want %s", test.existing, ops.Name(), cfg.DockerSock, test.want)
+		}
+	}
+}
+
+func TestSelectNoRuntime(t *testing.T) {
+	cfg := BackendConfig{Sockets: testSockets, Stat: statExisting()}
+	if ops, err := SelectSuspendResumeOps(&cfg); err == nil {
+		t.Errorf("selected %s; want an error", ops.Name())
+	}
+}
+
+func TestSelectConfiguredEndpoint(t *testing.T) {
+	cfg := BackendConfig{DockerSock: "/custom.sock", Sockets: testSockets, Stat: statExisting("/custom.sock")}
+	if ops, err := SelectSuspendResumeOps(&cfg); err != nil || ops.Name() != "docker" || cfg.DockerSock != "/custom.sock" {
+		t.Errorf("got %v, %v on %s; want docker on /custom.sock", ops, err, cfg.DockerSock)
+	}
+	// A TCP endpoint cannot be checked by stat
+	cfg = BackendConfig{DockerTcpAddress: "docker:2375", Sockets: testSockets, Stat: statExisting()}
+	if ops, err := SelectSuspendResumeOps(&cfg); err != nil || ops.Name() != "docker" {
+		t.Errorf("got %v, %v; want docker", ops, err)
+	}
+}
+
+func TestSelectFallbackSocket(t *testing.T) {
+	cfg := BackendConfig{Runtime: "docker", DockerSockFallback: "/test/fallback.sock", Sockets: testSockets, Stat: statExisting("/test/fallback.sock")}
+	if ops, err := SelectSuspendResumeOps(&cfg); err != nil || ops.Name() != "docker" {
+		t.Errorf("got %v, %v; want docker, as the fallback socket exists", ops, err)
+	}
+}
+
+func TestNoSuchContainer(t *testing.T) {
+	for _, ops := range []SuspendResumeOps{DockerSuspendResumeOps{}, PodmanSuspendResumeOps{}, CgroupFreezerOps{}} {
+		t.Run(ops.Name(), func(t *testing.T) {
+			stubDockerContainer(t, "running")
+			fakeCgroupfs(t, true)
+			suspendResumeOps = ops
+			for _, route := range []string{"/suspend/wsk1", "/resume/wsk1"} {
+				if w := serve(httptest.NewRequest("POST", route, nil)); w.Code != 404 {
+					t.Errorf("%s returned %d %s; want 404", route, w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPodmanBackend(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	stubDocker(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		// podman's Docker-compatible API answers pause and unpause like docker
+		w.WriteHeader(204)
+	})
+	suspendResumeOps = PodmanSuspendResumeOps{}
+	for _, route := range []string{"/suspend/wsk0", "/resume/wsk0"} {
+		if w := serve(httptest.NewRequest("POST", route, nil)); w.Code != 204 {
+			t.Errorf("%s returned %d %s; want 204", route, w.Code, w.Body.String())
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(calls, ", ") != "POST /containers/wsk0/pause, POST /containers/wsk0/unpause" {
+		t.Errorf("podman was called with %v", calls)
+	}
+}
+
+func TestBackendNames(t *testing.T) {
+	for _, runtime := range []string{"docker", "podman", "cgroup"} {
+		ops := suspendResumeOpsFor(runtime)
+		if ops == nil || ops.Name() != runtime {
+			t.Errorf("backend for %s is %v", runtime, ops)
+			continue
+		}
+		// Wrappers report the backend they wrap
+		if name := NewCircuitBreakerOps(ops).Name(); name != runtime {
+			t.Errorf("circuit breaker around %s is named %s", runtime, name)
+		}
+	}
+	if ops := suspendResumeOpsFor("runc"); ops != nil {
+		t.Errorf("got backend %s for an unknown runtime", ops.Name())
+	}
+}